@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// adminEffectiveConfig is the loaded config together with the settings
+// changed at runtime.
+type adminEffectiveConfig struct {
+	Config   *config    `json:"config"`
+	LogLevel string     `json:"log_level"`
+	Trace    []string   `json:"trace"`
+	Dump     dumpConfig `json:"dump"`
+}
+
+type adminLogLevel struct {
+	Level string `json:"level"`
+}
+
+func (s *server) initAdminRoutes() {
+	s.Admin.Use(s.logHTTP)
+	s.Admin.Use(s.adminAuth)
+
+	admin := s.Admin.PathPrefix("/admin").Subrouter()
+	admin.HandleFunc("/config", s.adminConfigHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/log/level", s.adminLogLevelHandler).Methods(http.MethodPut)
+	admin.HandleFunc("/trace/{certname}", s.adminTraceAddHandler).Methods(http.MethodPut)
+	admin.HandleFunc("/trace/{certname}", s.adminTraceRemoveHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/dump/targets/{certname}", s.adminDumpTargetAddHandler).Methods(http.MethodPut)
+	admin.HandleFunc("/dump/targets/{certname}", s.adminDumpTargetRemoveHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/dump/commands/{command}", s.adminDumpCommandHandler).Methods(http.MethodPut, http.MethodDelete)
+
+	// Dead letter directory
+	if s.DeadLetter != nil {
+		dl := admin.PathPrefix("/deadletter").Subrouter()
+		dl.HandleFunc("", s.deadLetterListHandler).Methods(http.MethodGet)
+		dl.HandleFunc("/retry", s.deadLetterRetryAllHandler).Methods(http.MethodPost)
+		dl.HandleFunc("/{id}", s.deadLetterGetHandler).Methods(http.MethodGet)
+		dl.HandleFunc("/{id}", s.deadLetterDeleteHandler).Methods(http.MethodDelete)
+		dl.HandleFunc("/{id}/retry", s.deadLetterRetryHandler).Methods(http.MethodPost)
+	}
+}
+
+// adminAuth checks the bearer token of admin API requests.
+func (s *server) adminAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(conf().Admin.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			s.Log.Warnf("unauthorized admin API request from %s", r.RemoteAddr)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func (s *server) adminConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var c adminEffectiveConfig
+	c.Config = conf()
+	c.LogLevel = s.Log.GetLevel().String()
+	c.Trace = traces.list()
+	c.Dump = dumps.config()
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(c)
+}
+
+func (s *server) adminLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var l adminLogLevel
+	err := json.NewDecoder(r.Body).Decode(&l)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	level, err := parseLogLevel(l.Level)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	s.Log.Warnf("log level changed from %s to %s by %s", s.Log.GetLevel(), level, r.RemoteAddr)
+	s.Log.SetLevel(level)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parseLogLevel accepts both level names and the numbers used by --log.level.
+func parseLogLevel(l string) (log.Level, error) {
+	if n, err := strconv.Atoi(l); err == nil && n >= int(log.PanicLevel) && n <= int(log.TraceLevel) {
+		return log.Level(n), nil
+	}
+	return log.ParseLevel(l)
+}
+
+func (s *server) adminTraceAddHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	certname := vars["certname"]
+
+	err := traces.add(certname)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	s.Log.Warnf("trace logging enabled for %s by %s", certname, r.RemoteAddr)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) adminTraceRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	certname := vars["certname"]
+
+	if !traces.remove(certname) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.Log.Warnf("trace logging disabled for %s by %s", certname, r.RemoteAddr)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) adminDumpTargetAddHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	certname := vars["certname"]
+
+	err := dumps.addTarget(certname)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	s.Log.Warnf("dump target %s added by %s", certname, r.RemoteAddr)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) adminDumpTargetRemoveHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	certname := vars["certname"]
+
+	if !dumps.removeTarget(certname) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	s.Log.Warnf("dump target %s removed by %s", certname, r.RemoteAddr)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) adminDumpCommandHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	command := vars["command"]
+	enabled := r.Method == http.MethodPut
+
+	err := dumps.setCommand(command, enabled)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	s.Log.Warnf("dump of %s command set to %t by %s", command, enabled, r.RemoteAddr)
+
+	w.WriteHeader(http.StatusNoContent)
+}
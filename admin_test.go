@@ -0,0 +1,192 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/mux"
+)
+
+// newTestAdmin returns a server with only the admin API routes, and fresh
+// tracer and dumper.
+func newTestAdmin() *server {
+	s := new(server)
+	s.Log = log.New()
+	s.Log.Out = ioutil.Discard
+	s.Admin = mux.NewRouter()
+	s.initAdminRoutes()
+
+	traces = newTracer(s.Log)
+	dumps = newDumper(dumpConfig{Dir: os.TempDir()})
+	return s
+}
+
+func TestAdminAPI(t *testing.T) {
+	setTestConfig(t, &config{Admin: adminConfig{Token: "secret"}})
+	defer func() { traces, dumps = nil, nil }()
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		body   string
+		want   int
+	}{
+		{
+			name:   "no token",
+			method: http.MethodPut,
+			path:   "/admin/trace/web01.example.com",
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name:   "wrong token",
+			method: http.MethodPut,
+			path:   "/admin/trace/web01.example.com",
+			token:  "guess",
+			want:   http.StatusUnauthorized,
+		},
+		{
+			name:   "trace",
+			method: http.MethodPut,
+			path:   "/admin/trace/web*.example.com",
+			token:  "secret",
+			want:   http.StatusNoContent,
+		},
+		{
+			name:   "invalid trace pattern",
+			method: http.MethodPut,
+			path:   "/admin/trace/[web",
+			token:  "secret",
+			want:   http.StatusBadRequest,
+		},
+		{
+			name:   "untrace unknown pattern",
+			method: http.MethodDelete,
+			path:   "/admin/trace/db01.example.com",
+			token:  "secret",
+			want:   http.StatusNotFound,
+		},
+		{
+			name:   "dump target",
+			method: http.MethodPut,
+			path:   "/admin/dump/targets/web01.example.com",
+			token:  "secret",
+			want:   http.StatusNoContent,
+		},
+		{
+			name:   "dump command",
+			method: http.MethodPut,
+			path:   "/admin/dump/commands/report",
+			token:  "secret",
+			want:   http.StatusNoContent,
+		},
+		{
+			name:   "unknown dump command",
+			method: http.MethodPut,
+			path:   "/admin/dump/commands/inventory",
+			token:  "secret",
+			want:   http.StatusBadRequest,
+		},
+		{
+			name:   "log level by number",
+			method: http.MethodPut,
+			path:   "/admin/log/level",
+			token:  "secret",
+			body:   `{"level":"5"}`,
+			want:   http.StatusNoContent,
+		},
+		{
+			name:   "unknown log level",
+			method: http.MethodPut,
+			path:   "/admin/log/level",
+			token:  "secret",
+			body:   `{"level":"verbose"}`,
+			want:   http.StatusBadRequest,
+		},
+	}
+	s := newTestAdmin()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			s.Admin.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Errorf("got status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+
+	if got := traces.list(); !reflect.DeepEqual(got, []string{"web*.example.com"}) {
+		t.Errorf("got traces %v", got)
+	}
+	if !dumps.match("web01.example.com", "report") || dumps.match("web01.example.com", "facts") {
+		t.Errorf("got dump config %+v", dumps.config())
+	}
+	if s.Log.GetLevel() != log.DebugLevel {
+		t.Errorf("got log level %s", s.Log.GetLevel())
+	}
+}
+
+func TestTracer(t *testing.T) {
+	tests := []struct {
+		name     string
+		targets  []string
+		certname string
+		want     bool
+	}{
+		{
+			name:     "no targets",
+			certname: "web01.example.com",
+		},
+		{
+			name:     "exact certname",
+			targets:  []string{"web01.example.com"},
+			certname: "web01.example.com",
+			want:     true,
+		},
+		{
+			name:     "glob",
+			targets:  []string{"db*", "web*.example.com"},
+			certname: "web01.example.com",
+			want:     true,
+		},
+		{
+			name:     "other node",
+			targets:  []string{"web*.example.com"},
+			certname: "db01.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			l := log.New()
+			l.Out = &out
+			l.SetLevel(log.ErrorLevel)
+			tr := newTracer(l)
+			for _, p := range tt.targets {
+				if err := tr.add(p); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tr.tracef(tt.certname, "received %s command", "store report")
+			if got := strings.Contains(out.String(), "received store report command"); got != tt.want {
+				t.Errorf("got traced %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var tr *tracer
+	if tr.match("web01.example.com") {
+		t.Error("nil tracer matches")
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Alert triggers.
+const (
+	alertFailed              = "failed"
+	alertConsecutiveFailures = "consecutive_failures"
+	alertRecovered           = "recovered"
+	alertNotReporting        = "not_reporting"
+)
+
+var alertTriggers = []string{alertFailed, alertConsecutiveFailures, alertRecovered, alertNotReporting}
+
+var alertsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "puppetdb_proxy_alerts_total",
+		Help: "Webhook alerts by trigger and result: sent, failed, deduplicated or dropped.",
+	},
+	[]string{"trigger", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(alertsTotal)
+}
+
+// alerts tracks run outcomes of nodes and sends webhook alerts.
+// It is nil outside of the server.
+var alerts *alerter
+
+// alert is sent to the webhooks as JSON, or rendered with their template.
+type alert struct {
+	Trigger             string   `json:"trigger"`
+	Certname            string   `json:"certname"`
+	Environment         string   `json:"environment,omitempty"`
+	Status              string   `json:"status,omitempty"`
+	ConsecutiveFailures int      `json:"consecutive_failures"`
+	LastReport          string   `json:"last_report,omitempty"`
+	FailedResources     []string `json:"failed_resources,omitempty"`
+	Message             string   `json:"message"`
+	Time                string   `json:"time"`
+}
+
+// alertNode is the run history of a node needed for the triggers.
+type alertNode struct {
+	environment  string
+	lastReport   time.Time
+	failures     int
+	notReporting bool
+}
+
+// alertDelivery is an alert queued for a webhook.
+type alertDelivery struct {
+	webhook alertWebhook
+	alert   alert
+}
+
+// alerter queues the alerts of every webhook separately, each with its own
+// sender, so a slow or dead webhook doesn't hold up the others.
+type alerter struct {
+	mu     sync.Mutex
+	log    *log.Logger
+	nodes  map[string]*alertNode
+	sent   map[string]time.Time          // certname and trigger to the time of the last alert
+	queues map[string]chan alertDelivery // webhook URL to its queue
+	wg     sync.WaitGroup
+	closed bool
+	stop   chan struct{}
+}
+
+func newAlerter(logger *log.Logger) *alerter {
+	a := &alerter{
+		log:    logger,
+		nodes:  make(map[string]*alertNode),
+		sent:   make(map[string]time.Time),
+		queues: make(map[string]chan alertDelivery),
+		stop:   make(chan struct{}),
+	}
+	go a.watch()
+	return a
+}
+
+// observe updates the history of the node from a converted report and
+// queues the alerts it triggers.
+func (a *alerter) observe(r *v4Report) {
+	if a == nil || r == nil {
+		return
+	}
+	c := conf().Alerts
+	if len(c.Webhooks) == 0 || !c.allowed(r.Certname) {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	n, ok := a.nodes[r.Certname]
+	if !ok {
+		if c.MaxNodes > 0 && len(a.nodes) >= c.MaxNodes {
+			a.log.Debugf("not tracking alerts of %s, %d nodes tracked already", r.Certname, len(a.nodes))
+			return
+		}
+		n = new(alertNode)
+		a.nodes[r.Certname] = n
+	}
+	n.environment = r.Environment
+	n.lastReport = time.Now()
+
+	e := newAlert(r.Certname, n)
+	e.Status = r.Status
+	switch r.Status {
+	case "failed":
+		n.failures++
+		e.ConsecutiveFailures = n.failures
+		e.FailedResources = failedResources(r)
+		e.Message = fmt.Sprintf("Puppet run on %s failed", r.Certname)
+		a.trigger(alertFailed, e)
+		if c.ConsecutiveFailures > 0 && n.failures == c.ConsecutiveFailures {
+			e.Message = fmt.Sprintf("Puppet run on %s failed %d times in a row", r.Certname, n.failures)
+			a.trigger(alertConsecutiveFailures, e)
+		}
+	case "changed", "unchanged":
+		if n.failures > 0 || n.notReporting {
+			e.Message = fmt.Sprintf("Puppet run on %s recovered with status %s", r.Certname, r.Status)
+			a.trigger(alertRecovered, e)
+		}
+		n.failures = 0
+	}
+	n.notReporting = false
+}
+
+// forget stops tracking the node, e.g. when it is deactivated.
+func (a *alerter) forget(certname string) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	delete(a.nodes, certname)
+}
+
+// watch looks for nodes that stopped reporting.
+func (a *alerter) watch() {
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-time.After(conf().Alerts.CheckInterval):
+		}
+		a.checkNotReporting()
+	}
+}
+
+func (a *alerter) checkNotReporting() {
+	c := conf().Alerts
+	if c.NotReportingAfter <= 0 {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for certname, n := range a.nodes {
+		if n.notReporting || time.Since(n.lastReport) < c.NotReportingAfter {
+			continue
+		}
+		n.notReporting = true
+		e := newAlert(certname, n)
+		e.Message = fmt.Sprintf("%s has not reported for %s", certname, time.Since(n.lastReport).Round(time.Second))
+		a.trigger(alertNotReporting, e)
+	}
+}
+
+// trigger queues the alert for the webhooks that want it, unless the same
+// one was sent for the node within the dedup window. It is called with the
+// lock held.
+func (a *alerter) trigger(trigger string, e alert) {
+	c := conf().Alerts
+	e.Trigger = trigger
+	if a.closed {
+		return
+	}
+
+	key := e.Certname + "\x00" + trigger
+	if last, ok := a.sent[key]; ok && time.Since(last) < c.DedupWindow {
+		alertsTotal.WithLabelValues(trigger, "deduplicated").Inc()
+		return
+	}
+	for k, last := range a.sent {
+		if time.Since(last) >= c.DedupWindow {
+			delete(a.sent, k)
+		}
+	}
+
+	var queued bool
+	for _, w := range c.Webhooks {
+		if !w.wants(trigger) {
+			continue
+		}
+		select {
+		case a.queue(w.URL) <- alertDelivery{webhook: w, alert: e}:
+			queued = true
+		default:
+			alertsTotal.WithLabelValues(trigger, "dropped").Inc()
+			a.log.Errorf("alert queue of %s is full, dropping %s alert of %s", w.URL, trigger, e.Certname)
+		}
+	}
+	if queued {
+		a.sent[key] = time.Now()
+	}
+}
+
+// queue returns the queue of the webhook, starting its sender on first use.
+// It is called with the lock held.
+func (a *alerter) queue(url string) chan alertDelivery {
+	q, ok := a.queues[url]
+	if !ok {
+		q = make(chan alertDelivery, 1000)
+		a.queues[url] = q
+		a.wg.Add(1)
+		go a.send(q)
+	}
+	return q
+}
+
+// send delivers the alerts of a webhook queue until it is closed.
+func (a *alerter) send(queue chan alertDelivery) {
+	defer a.wg.Done()
+	for d := range queue {
+		e, w := d.alert, d.webhook
+		if err := a.deliver(w, e); err != nil {
+			alertsTotal.WithLabelValues(e.Trigger, "failed").Inc()
+			a.log.Errorf("failed to send %s alert of %s to %s: %v", e.Trigger, e.Certname, w.URL, err)
+			continue
+		}
+		alertsTotal.WithLabelValues(e.Trigger, "sent").Inc()
+	}
+}
+
+// deliver posts the alert to the webhook, retrying with a doubling delay
+// for at most the configured retry time.
+func (a *alerter) deliver(w alertWebhook, e alert) error {
+	c := conf().Alerts
+	body, err := w.render(e)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(c.MaxRetryTime)
+	delay := c.RetryInterval
+	for attempt := 0; ; attempt++ {
+		err = postAlert(w, body, c.Timeout)
+		if err == nil || attempt >= c.Retries || time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		a.log.Warnf("failed to send %s alert of %s to %s, retrying in %s: %v", e.Trigger, e.Certname, w.URL, delay, err)
+		select {
+		case <-a.stop:
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func postAlert(w alertWebhook, body []byte, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// close stops the watcher and sends the queued alerts until ctx is done.
+func (a *alerter) close(ctx context.Context) error {
+	if a == nil {
+		return nil
+	}
+	a.mu.Lock()
+	a.closed = true
+	for _, q := range a.queues {
+		close(q)
+	}
+	a.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(done)
+	}()
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	close(a.stop)
+
+	return err
+}
+
+func newAlert(certname string, n *alertNode) alert {
+	var e alert
+	e.Certname = certname
+	e.Environment = n.environment
+	e.ConsecutiveFailures = n.failures
+	e.LastReport = n.lastReport.Format(time.RFC3339)
+	e.Time = time.Now().Format(time.RFC3339)
+	return e
+}
+
+func failedResources(r *v4Report) []string {
+	var failed []string
+	for _, res := range r.Resources {
+		for _, ev := range res.Events {
+			if ev.Status == "failure" {
+				failed = append(failed, fmt.Sprintf("%s[%s]", res.ResourceType, res.ResourceTitle))
+				break
+			}
+		}
+	}
+	return failed
+}
+
+// render returns the alert as JSON, or rendered with the webhook template.
+func (w alertWebhook) render(e alert) ([]byte, error) {
+	if w.Template == "" {
+		return json.Marshal(&e)
+	}
+	t, err := parseAlertTemplate(w.Template)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, e); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (w alertWebhook) wants(trigger string) bool {
+	return len(w.Triggers) == 0 || contains(w.Triggers, trigger)
+}
+
+// parseAlertTemplate parses a webhook body template, "json" quotes a value
+// for use in a JSON body, e.g. {"text": {{json .Message}}}.
+func parseAlertTemplate(text string) (*template.Template, error) {
+	return template.New("alert").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			j, err := json.Marshal(v)
+			return string(j), err
+		},
+	}).Parse(text)
+}
+
+// allowed reports whether alerts are sent for the certname.
+func (c alertsConfig) allowed(certname string) bool {
+	if len(c.Certnames) == 0 {
+		return true
+	}
+	for _, p := range c.Certnames {
+		if ok, _ := path.Match(p, certname); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// alertRecorder is a webhook recording the triggers of the alerts it receives.
+type alertRecorder struct {
+	mu       sync.Mutex
+	triggers []string
+	received chan struct{}
+}
+
+func newAlertRecorder() (*alertRecorder, *httptest.Server) {
+	rec := &alertRecorder{received: make(chan struct{}, 100)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e alert
+		json.NewDecoder(r.Body).Decode(&e)
+		rec.mu.Lock()
+		rec.triggers = append(rec.triggers, e.Trigger)
+		rec.mu.Unlock()
+		rec.received <- struct{}{}
+	}))
+	return rec, srv
+}
+
+func newTestAlerter() *alerter {
+	l := log.New()
+	l.Out = ioutil.Discard
+	return newAlerter(l)
+}
+
+func TestAlerterTriggers(t *testing.T) {
+	tests := []struct {
+		name        string
+		dedupWindow time.Duration
+		statuses    []string
+		want        []string
+	}{
+		{
+			name:     "unchanged",
+			statuses: []string{"unchanged", "changed"},
+		},
+		{
+			name:     "failed and recovered",
+			statuses: []string{"changed", "failed", "unchanged"},
+			want:     []string{alertFailed, alertRecovered},
+		},
+		{
+			name:        "consecutive failures",
+			dedupWindow: time.Nanosecond,
+			statuses:    []string{"failed", "failed", "failed", "failed"},
+			want:        []string{alertFailed, alertFailed, alertFailed, alertConsecutiveFailures, alertFailed},
+		},
+		{
+			name:     "repeated failures deduplicated",
+			statuses: []string{"failed", "failed", "failed"},
+			want:     []string{alertFailed, alertConsecutiveFailures},
+		},
+		{
+			name:     "recovered once within the dedup window",
+			statuses: []string{"failed", "changed", "failed", "changed"},
+			want:     []string{alertFailed, alertRecovered},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, srv := newAlertRecorder()
+			defer srv.Close()
+			setTestConfig(t, &config{Alerts: alertsConfig{
+				Webhooks:            []alertWebhook{{URL: srv.URL}},
+				ConsecutiveFailures: 3,
+				DedupWindow:         tt.dedupWindow,
+			}})
+
+			a := newTestAlerter()
+			for _, s := range tt.statuses {
+				a.observe(&v4Report{Certname: "web01.example.com", Status: s})
+				if tt.dedupWindow > 0 {
+					time.Sleep(tt.dedupWindow)
+				}
+			}
+			if err := a.close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rec.triggers, tt.want) {
+				t.Errorf("got %v, want %v", rec.triggers, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlerterNotReporting(t *testing.T) {
+	rec, srv := newAlertRecorder()
+	defer srv.Close()
+	setTestConfig(t, &config{Alerts: alertsConfig{
+		Webhooks:          []alertWebhook{{URL: srv.URL, Triggers: []string{alertNotReporting, alertRecovered}}},
+		NotReportingAfter: time.Millisecond,
+	}})
+
+	a := newTestAlerter()
+	a.observe(&v4Report{Certname: "web01.example.com", Status: "changed"})
+	time.Sleep(2 * time.Millisecond)
+	a.checkNotReporting()
+	a.checkNotReporting()
+	a.observe(&v4Report{Certname: "web01.example.com", Status: "unchanged"})
+	a.close(context.Background())
+
+	want := []string{alertNotReporting, alertRecovered}
+	if !reflect.DeepEqual(rec.triggers, want) {
+		t.Errorf("got %v, want %v", rec.triggers, want)
+	}
+}
+
+func TestAlerterDeadWebhook(t *testing.T) {
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer dead.Close()
+	rec, srv := newAlertRecorder()
+	defer srv.Close()
+	setTestConfig(t, &config{Alerts: alertsConfig{
+		Webhooks:      []alertWebhook{{URL: dead.URL}, {URL: srv.URL}},
+		Retries:       10,
+		RetryInterval: time.Minute,
+	}})
+
+	a := newTestAlerter()
+	a.observe(&v4Report{Certname: "web01.example.com", Status: "failed"})
+	a.observe(&v4Report{Certname: "web02.example.com", Status: "failed"})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-rec.received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("alert held up by the dead webhook")
+		}
+	}
+
+	// The retries of the dead webhook are abandoned on shutdown.
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := a.close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestAlerterRetryTime(t *testing.T) {
+	var requests int
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer dead.Close()
+	// Retries after 20ms and 40ms, the next one after 80ms would end past the
+	// retry time.
+	setTestConfig(t, &config{Alerts: alertsConfig{
+		Retries:       10,
+		RetryInterval: 20 * time.Millisecond,
+		MaxRetryTime:  100 * time.Millisecond,
+	}})
+
+	a := newTestAlerter()
+	defer a.close(context.Background())
+	if err := a.deliver(alertWebhook{URL: dead.URL}, alert{Trigger: alertFailed}); err == nil {
+		t.Fatal("no error from a dead webhook")
+	}
+	if requests != 3 {
+		t.Errorf("got %d requests, want 3", requests)
+	}
+}
+
+func TestAlertWebhookRender(t *testing.T) {
+	e := alert{Trigger: alertFailed, Certname: "web01.example.com", Message: `Puppet run on "web01" failed`}
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "template",
+			template: `{"text": {{json .Message}}}`,
+			want:     `{"text": "Puppet run on \"web01\" failed"}`,
+		},
+		{
+			name: "JSON",
+			want: `{"trigger":"failed","certname":"web01.example.com","consecutive_failures":0,"message":"Puppet run on \"web01\" failed","time":""}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := alertWebhook{Template: tt.template}.render(e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
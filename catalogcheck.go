@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Catalog findings.
+const (
+	findingDuplicateResource   = "duplicate_resource"
+	findingInvalidRelationship = "invalid_relationship"
+	findingDanglingEdge        = "dangling_edge"
+	findingMissingMain         = "missing_main"
+)
+
+var catalogFindings = []string{findingDuplicateResource, findingInvalidRelationship, findingDanglingEdge, findingMissingMain}
+
+// Actions on catalog findings.
+const (
+	catalogRepair = "repair"
+	catalogReject = "reject"
+	catalogIgnore = "ignore"
+)
+
+var catalogActions = []string{catalogRepair, catalogReject, catalogIgnore}
+
+// catalogRelationships are the edge relationships PuppetDB accepts.
+var catalogRelationships = []string{"contains", "before", "required-by", "notifies", "subscription-of"}
+
+// catalogReverseRelationships are written the other way round in PuppetDB,
+// e.g. A requires B is B required-by A.
+var catalogReverseRelationships = map[string]string{
+	"require":    "required-by",
+	"requires":   "required-by",
+	"subscribe":  "subscription-of",
+	"subscribes": "subscription-of",
+	"notify":     "notifies",
+}
+
+var catalogFindingsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "puppetdb_proxy_catalog_findings_total",
+		Help: "Problems found in catalogs by finding and action: repaired, rejected or ignored.",
+	},
+	[]string{"finding", "action"},
+)
+
+func init() {
+	prometheus.MustRegister(catalogFindingsTotal)
+}
+
+// catalogCheck logs the findings of the catalog validation. Catalogs are
+// validated without logging outside of the server, where it is nil.
+var catalogCheck *catalogValidator
+
+type catalogValidator struct {
+	log *log.Logger
+}
+
+// validate finds the problems PuppetDB rejects a catalog for: duplicate
+// resources, invalid relationships, edges to missing resources and a
+// missing Stage[main] or Class[main]. Findings are repaired, ignored, or
+// reject the whole catalog, as the policy says.
+func (v *catalogValidator) validate(c *v4Catalog) error {
+	var rejected []string
+	found := func(finding, format string, args ...interface{}) bool {
+		action := conf().CatalogValidation.action(finding)
+		catalogFindingsTotal.WithLabelValues(finding, actionResult(action)).Inc()
+		msg := fmt.Sprintf(format, args...)
+		if v != nil {
+			v.log.Warnf("catalog of %s: %s: %s (%s)", c.Certname, finding, msg, action)
+		}
+		traces.tracef(c.Certname, "catalog %s: %s (%s)", finding, msg, action)
+		if action == catalogReject {
+			rejected = append(rejected, msg)
+		}
+		return action == catalogRepair
+	}
+
+	// Duplicate resources, the first one is kept.
+	seen := make(map[resourceSpec]bool, len(c.Resources))
+	resources := make(catalogResources, 0, len(c.Resources))
+	for _, res := range c.Resources {
+		spec := resourceSpec{Type: res.Type, Title: res.Title}
+		if seen[spec] && found(findingDuplicateResource, "%s[%s] is declared twice", res.Type, res.Title) {
+			continue
+		}
+		seen[spec] = true
+		resources = append(resources, res)
+	}
+	c.Resources = resources
+
+	// An ignored invalid relationship is kept as is. A repaired one is checked
+	// for missing resources like the other edges, and gets a dangling edge
+	// finding too.
+	edges := make(catalogEdges, 0, len(c.Edges))
+	for _, e := range c.Edges {
+		if !contains(catalogRelationships, e.Relationship) {
+			normalized, reverse := normalizeRelationship(e.Relationship)
+			msg := fmt.Sprintf("%s[%s] %s %s[%s]", e.Source.Type, e.Source.Title, e.Relationship, e.Target.Type, e.Target.Title)
+			if !found(findingInvalidRelationship, "%s", msg) {
+				edges = append(edges, e)
+				continue
+			}
+			if normalized == "" {
+				continue
+			}
+			e.Relationship = normalized
+			if reverse {
+				e.Source, e.Target = e.Target, e.Source
+			}
+		}
+		var missing []string
+		for _, end := range []resourceSpec{e.Source, e.Target} {
+			if !seen[end] {
+				missing = append(missing, end.Type+"["+end.Title+"]")
+			}
+		}
+		if len(missing) > 0 && found(findingDanglingEdge, "%s[%s] %s %s[%s] points at missing %s",
+			e.Source.Type, e.Source.Title, e.Relationship, e.Target.Type, e.Target.Title, strings.Join(missing, " and ")) {
+			continue
+		}
+		edges = append(edges, e)
+	}
+	c.Edges = edges
+
+	stage := resourceSpec{Type: "Stage", Title: "main"}
+	if !seen[stage] && found(findingMissingMain, "Stage[main] is missing") {
+		c.Resources = append(c.Resources, mainResource(stage))
+		seen[stage] = true
+	}
+	class := resourceSpec{Type: "Class", Title: "main"}
+	if !seen[class] && !seen[resourceSpec{Type: "Class", Title: "Main"}] && found(findingMissingMain, "Class[main] is missing") {
+		c.Resources = append(c.Resources, mainResource(class))
+		if seen[stage] {
+			c.Edges = append(c.Edges, catalogEdge{Relationship: "contains", Source: stage, Target: class})
+		}
+	}
+
+	if len(rejected) > 0 {
+		return fmt.Errorf("catalog of %s rejected: %s", c.Certname, strings.Join(rejected, "; "))
+	}
+	return nil
+}
+
+// normalizeRelationship returns the PuppetDB name of a relationship written
+// differently, e.g. required_by or Notify, and whether the edge must be
+// reversed. It is empty for unknown relationships.
+func normalizeRelationship(relationship string) (string, bool) {
+	r := strings.Replace(strings.ToLower(strings.TrimSpace(relationship)), "_", "-", -1)
+	if contains(catalogRelationships, r) {
+		return r, false
+	}
+	if r, ok := catalogReverseRelationships[r]; ok {
+		return r, r != "notifies"
+	}
+	return "", false
+}
+
+func mainResource(spec resourceSpec) catalogResource {
+	return catalogResource{
+		Type:       spec.Type,
+		Title:      spec.Title,
+		Tags:       []string{strings.ToLower(spec.Type)},
+		Parameters: []byte("{}"),
+	}
+}
+
+func actionResult(action string) string {
+	switch action {
+	case catalogRepair:
+		return "repaired"
+	case catalogReject:
+		return "rejected"
+	}
+	return "ignored"
+}
+
+// action returns the action on the finding: its own policy, or the default one.
+func (c catalogValidationConfig) action(finding string) string {
+	if a, ok := c.Findings[finding]; ok {
+		return a
+	}
+	return c.Policy
+}
+
+// check validates the actions of the policy.
+func (c catalogValidationConfig) check() error {
+	if !contains(catalogActions, c.Policy) {
+		return fmt.Errorf("invalid catalog validation policy %q, want one of %s", c.Policy, strings.Join(catalogActions, ", "))
+	}
+	for finding, action := range c.Findings {
+		if !contains(catalogFindings, finding) {
+			return fmt.Errorf("unknown catalog finding %q, want one of %s", finding, strings.Join(catalogFindings, ", "))
+		}
+		if !contains(catalogActions, action) {
+			return fmt.Errorf("invalid action %q for catalog finding %s, want one of %s", action, finding, strings.Join(catalogActions, ", "))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// findingsCount returns the number of catalog findings counted so far.
+func findingsCount() float64 {
+	var n float64
+	for _, finding := range catalogFindings {
+		for _, action := range catalogActions {
+			var m dto.Metric
+			catalogFindingsTotal.WithLabelValues(finding, actionResult(action)).Write(&m)
+			n += m.GetCounter().GetValue()
+		}
+	}
+	return n
+}
+
+func TestValidateEdgeFindings(t *testing.T) {
+	spec := func(t, title string) resourceSpec { return resourceSpec{Type: t, Title: title} }
+	tests := []struct {
+		name         string
+		edge         catalogEdge
+		policy       string
+		findings     map[string]string
+		wantErr      bool
+		wantFindings float64
+		edges        int
+	}{
+		{
+			name:         "invalid rejected",
+			edge:         catalogEdge{Relationship: "require", Source: spec("File", "a"), Target: spec("File", "missing")},
+			policy:       catalogReject,
+			wantErr:      true,
+			wantFindings: 1,
+			edges:        1,
+		},
+		{
+			name:         "both ends dangling rejected",
+			edge:         catalogEdge{Relationship: "before", Source: spec("File", "x"), Target: spec("File", "y")},
+			policy:       catalogReject,
+			wantErr:      true,
+			wantFindings: 1,
+			edges:        1,
+		},
+		{
+			name:         "invalid and dangling repaired",
+			edge:         catalogEdge{Relationship: "require", Source: spec("File", "a"), Target: spec("File", "missing")},
+			policy:       catalogRepair,
+			wantFindings: 2,
+		},
+		{
+			name:         "both ends dangling repaired",
+			edge:         catalogEdge{Relationship: "before", Source: spec("File", "x"), Target: spec("File", "y")},
+			policy:       catalogRepair,
+			wantFindings: 1,
+		},
+		{
+			name:         "invalid repaired",
+			edge:         catalogEdge{Relationship: "require", Source: spec("File", "a"), Target: spec("File", "b")},
+			policy:       catalogRepair,
+			wantFindings: 1,
+			edges:        1,
+		},
+		{
+			name:         "invalid ignored",
+			edge:         catalogEdge{Relationship: "require", Source: spec("File", "a"), Target: spec("File", "missing")},
+			policy:       catalogIgnore,
+			wantFindings: 1,
+			edges:        1,
+		},
+		{
+			name:         "repaired relationship dangling rejected",
+			edge:         catalogEdge{Relationship: "require", Source: spec("File", "a"), Target: spec("File", "missing")},
+			policy:       catalogRepair,
+			findings:     map[string]string{findingDanglingEdge: catalogReject},
+			wantErr:      true,
+			wantFindings: 2,
+			edges:        1,
+		},
+		{
+			name:         "repaired relationship dangling ignored",
+			edge:         catalogEdge{Relationship: "require", Source: spec("File", "a"), Target: spec("File", "missing")},
+			policy:       catalogRepair,
+			findings:     map[string]string{findingDanglingEdge: catalogIgnore},
+			wantFindings: 2,
+			edges:        1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setConfig(&config{CatalogValidation: catalogValidationConfig{Policy: tt.policy, Findings: tt.findings}})
+			c := &v4Catalog{
+				Certname: "web01.example.com",
+				Resources: catalogResources{
+					mainResource(spec("Stage", "main")),
+					mainResource(spec("Class", "main")),
+					{Type: "File", Title: "a"},
+					{Type: "File", Title: "b"},
+				},
+				Edges: catalogEdges{tt.edge},
+			}
+			before := findingsCount()
+			var v *catalogValidator
+			err := v.validate(c)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v", err)
+			}
+			if n := findingsCount() - before; n != tt.wantFindings {
+				t.Errorf("got %v findings for the edge, want %v", n, tt.wantFindings)
+			}
+			if len(c.Edges) != tt.edges {
+				t.Errorf("got %d edges, want %d", len(c.Edges), tt.edges)
+			}
+		})
+	}
+}
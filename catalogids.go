@@ -0,0 +1,251 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Cached catalog statuses of a report.
+const (
+	catalogNotUsed = "not_used"
+	catalogCached  = "on_failure"
+)
+
+// catalogIDsSaveInterval is how often changed catalog UUIDs are saved to disk.
+const catalogIDsSaveInterval = time.Minute
+
+var catalogIDsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "puppetdb_proxy_catalog_uuids_total",
+		Help: "Catalog UUIDs of reports by result: matched a catalog of the run, cached catalog of an earlier run, or unknown.",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(catalogIDsTotal)
+}
+
+// catalogIDs links reports to their catalogs. It is nil outside of the server.
+var catalogIDs *catalogUUIDs
+
+// catalogUUIDs maps the certname and transaction UUID of the converted
+// catalogs to their catalog UUID. The oldest entries are evicted when the
+// map is full.
+type catalogUUIDs struct {
+	mu      sync.Mutex
+	log     *log.Logger
+	path    string
+	entries map[catalogKey]*list.Element
+	order   *list.List               // oldest first
+	last    map[string]*list.Element // certname to its last catalog
+	changes int                      // since the last save
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+type catalogKey struct {
+	Certname        string `json:"certname"`
+	TransactionUUID string `json:"transaction_uuid"`
+}
+
+// catalogID is an entry of the map, and of its file.
+type catalogID struct {
+	catalogKey
+	CatalogUUID string `json:"catalog_uuid"`
+}
+
+// newCatalogUUIDs loads the entries saved in path, if set, and saves them
+// back periodically.
+func newCatalogUUIDs(path string, logger *log.Logger) (*catalogUUIDs, error) {
+	m := &catalogUUIDs{
+		log:     logger,
+		path:    path,
+		entries: make(map[catalogKey]*list.Element),
+		order:   list.New(),
+		last:    make(map[string]*list.Element),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if path == "" {
+		close(m.done)
+		return m, nil
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var ids []catalogID
+		if err := json.Unmarshal(b, &ids); err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			m.add(id)
+		}
+	}
+	go m.run()
+
+	return m, nil
+}
+
+// catalogUUID returns the catalog UUID of the node's catalog for the
+// transaction, generating it the first time.
+func (m *catalogUUIDs) catalogUUID(certname, transactionUUID string) string {
+	if m == nil || transactionUUID == "" || conf().CatalogUUIDs.MaxEntries <= 0 {
+		return uuid.New().String()
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := catalogKey{Certname: certname, TransactionUUID: transactionUUID}
+	if e, ok := m.entries[key]; ok {
+		return e.Value.(catalogID).CatalogUUID
+	}
+	id := catalogID{catalogKey: key, CatalogUUID: uuid.New().String()}
+	m.add(id)
+	m.changes++
+
+	return id.CatalogUUID
+}
+
+// report returns the catalog UUID and cached catalog status of the run. A
+// run without a catalog of its own applied the last catalog of the node.
+func (m *catalogUUIDs) report(certname, transactionUUID string) (string, string) {
+	if m == nil || transactionUUID == "" {
+		catalogIDsTotal.WithLabelValues("unknown").Inc()
+		return uuid.New().String(), catalogNotUsed
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[catalogKey{Certname: certname, TransactionUUID: transactionUUID}]; ok {
+		catalogIDsTotal.WithLabelValues("matched").Inc()
+		return e.Value.(catalogID).CatalogUUID, catalogNotUsed
+	}
+	if e, ok := m.last[certname]; ok {
+		catalogIDsTotal.WithLabelValues("cached").Inc()
+		return e.Value.(catalogID).CatalogUUID, catalogCached
+	}
+	catalogIDsTotal.WithLabelValues("unknown").Inc()
+	return uuid.New().String(), catalogNotUsed
+}
+
+// forget drops the entries of the node, e.g. when it is deactivated.
+func (m *catalogUUIDs) forget(certname string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, e := range m.entries {
+		if key.Certname == certname {
+			m.remove(e)
+		}
+	}
+}
+
+// add inserts the entry as the newest one and evicts the oldest entries
+// over the limit. It is called with the lock held.
+func (m *catalogUUIDs) add(id catalogID) {
+	if e, ok := m.entries[id.catalogKey]; ok {
+		m.remove(e)
+	}
+	e := m.order.PushBack(id)
+	m.entries[id.catalogKey] = e
+	m.last[id.Certname] = e
+	for max := conf().CatalogUUIDs.MaxEntries; m.order.Len() > max && max > 0; {
+		m.remove(m.order.Front())
+	}
+}
+
+func (m *catalogUUIDs) remove(e *list.Element) {
+	id := m.order.Remove(e).(catalogID)
+	delete(m.entries, id.catalogKey)
+	if m.last[id.Certname] == e {
+		delete(m.last, id.Certname)
+	}
+	m.changes++
+}
+
+func (m *catalogUUIDs) run() {
+	defer close(m.done)
+
+	tick := time.NewTicker(catalogIDsSaveInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-tick.C:
+			if err := m.save(); err != nil {
+				m.log.Errorf("failed to save catalog UUIDs to %s: %v", m.path, err)
+			}
+		}
+	}
+}
+
+// save writes the entries, oldest first, to the file if they changed. The
+// changes are marked as saved once the file is in place, so a failed save is
+// retried on the next tick.
+func (m *catalogUUIDs) save() error {
+	m.mu.Lock()
+	changes := m.changes
+	if changes == 0 {
+		m.mu.Unlock()
+		return nil
+	}
+	ids := make([]catalogID, 0, m.order.Len())
+	for e := m.order.Front(); e != nil; e = e.Next() {
+		ids = append(ids, e.Value.(catalogID))
+	}
+	m.mu.Unlock()
+
+	j, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0750); err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash never leaves a truncated file.
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, j, 0640); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, m.path); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.changes -= changes
+	m.mu.Unlock()
+	return nil
+}
+
+// close stops the periodic saves and saves the entries a last time.
+func (m *catalogUUIDs) close(ctx context.Context) error {
+	if m == nil || m.path == "" {
+		return nil
+	}
+	close(m.stop)
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return m.save()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func newTestCatalogUUIDs(t *testing.T, path string) *catalogUUIDs {
+	l := log.New()
+	l.Out = ioutil.Discard
+	m, err := newCatalogUUIDs(path, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestCatalogUUIDsReport(t *testing.T) {
+	setTestConfig(t, &config{CatalogUUIDs: catalogUUIDsConfig{MaxEntries: 10}})
+	m := newTestCatalogUUIDs(t, "")
+	first := m.catalogUUID("web01.example.com", "tx-1")
+	last := m.catalogUUID("web01.example.com", "tx-2")
+	if again := m.catalogUUID("web01.example.com", "tx-1"); again != first {
+		t.Fatalf("got catalog UUID %s for the same transaction, want %s", again, first)
+	}
+
+	tests := []struct {
+		name            string
+		certname        string
+		transactionUUID string
+		wantUUID        string
+		wantStatus      string
+	}{
+		{"catalog of the run", "web01.example.com", "tx-1", first, catalogNotUsed},
+		{"cached catalog", "web01.example.com", "tx-3", last, catalogCached},
+		{"unknown node", "db01.example.com", "tx-1", "", catalogNotUsed},
+		{"no transaction", "web01.example.com", "", "", catalogNotUsed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, status := m.report(tt.certname, tt.transactionUUID)
+			if status != tt.wantStatus {
+				t.Errorf("got status %s, want %s", status, tt.wantStatus)
+			}
+			if tt.wantUUID != "" && id != tt.wantUUID {
+				t.Errorf("got catalog UUID %s, want %s", id, tt.wantUUID)
+			}
+			if tt.wantUUID == "" && (id == first || id == last) {
+				t.Errorf("got catalog UUID %s of another run", id)
+			}
+		})
+	}
+}
+
+func TestCatalogUUIDsEviction(t *testing.T) {
+	setTestConfig(t, &config{CatalogUUIDs: catalogUUIDsConfig{MaxEntries: 2}})
+	m := newTestCatalogUUIDs(t, "")
+	m.catalogUUID("web01.example.com", "tx-1")
+	m.catalogUUID("web02.example.com", "tx-2")
+	m.catalogUUID("web03.example.com", "tx-3")
+	if _, status := m.report("web01.example.com", "tx-4"); status != catalogNotUsed {
+		t.Error("oldest catalog not evicted")
+	}
+	if _, status := m.report("web02.example.com", "tx-4"); status != catalogCached {
+		t.Error("catalog evicted before the oldest one")
+	}
+
+	m.forget("web03.example.com")
+	if _, status := m.report("web03.example.com", "tx-3"); status != catalogNotUsed {
+		t.Error("catalog of a forgotten node kept")
+	}
+}
+
+func TestCatalogUUIDsSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puppetdb-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	setTestConfig(t, &config{CatalogUUIDs: catalogUUIDsConfig{MaxEntries: 10}})
+
+	path := filepath.Join(dir, "catalog-uuids.json")
+	m := newTestCatalogUUIDs(t, path)
+	id := m.catalogUUID("web01.example.com", "tx-1")
+
+	// A directory in the way fails the rename, the changes are kept for the
+	// next save.
+	os.MkdirAll(filepath.Join(path, "in-the-way"), 0750)
+	if err := m.save(); err == nil {
+		t.Fatal("no error saving over a directory")
+	}
+	if m.changes == 0 {
+		t.Fatal("changes marked as saved after a failed save")
+	}
+
+	os.RemoveAll(path)
+	if err := m.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if m.changes != 0 {
+		t.Errorf("got %d unsaved changes", m.changes)
+	}
+
+	loaded := newTestCatalogUUIDs(t, path)
+	defer loaded.close(context.Background())
+	if got, status := loaded.report("web01.example.com", "tx-1"); got != id || status != catalogNotUsed {
+		t.Errorf("got catalog UUID %s %s after load, want %s", got, status, id)
+	}
+}
@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/json"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 type v3Catalog struct {
@@ -84,11 +82,10 @@ func v3toV4CatalogConv(v3c v3Catalog) v4Catalog {
 	var v4c v4Catalog
 	v4c.Certname = v3c.Name
 	v4c.Version = v3c.Version
-	v4c.Environment = opts.Environment
+	v4c.Environment, v4c.Producer = conf().rewrite(v3c.Name)
 	v4c.TransactionUUID = v3c.TransactionUUID
-	v4c.Producer = opts.Producer
 	v4c.ProducerTimestamp = time.Now().Format(time.RFC3339)
-	v4c.CatalogUUID = uuid.New().String()
+	v4c.CatalogUUID = catalogIDs.catalogUUID(v3c.Name, v3c.TransactionUUID)
 	v4c.Edges = v3c.Edges
 	v4c.Resources = v3c.Resources
 
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	catalogValuesStripped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_catalog_values_stripped_total",
+			Help: "Catalog parameter values over the size limit replaced by their hash.",
+		},
+	)
+	catalogBytesStripped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_catalog_stripped_bytes_total",
+			Help: "Size in bytes of the catalog parameter values replaced by their hash.",
+		},
+	)
+	catalogLargestResource = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "puppetdb_proxy_catalog_largest_resource_bytes",
+			Help: "Parameter size in bytes of the largest resource of the last catalog of nodes with stripped values.",
+		},
+		[]string{"certname"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(catalogValuesStripped)
+	prometheus.MustRegister(catalogBytesStripped)
+	prometheus.MustRegister(catalogLargestResource)
+}
+
+// catalogSizes logs the catalogs with stripped values and keeps track of
+// the nodes with a largest resource series. Values are stripped without
+// logging or series outside of the server, where it is nil.
+var catalogSizes *catalogStripper
+
+type catalogStripper struct {
+	log   *log.Logger
+	mu    sync.Mutex
+	nodes map[string]bool
+}
+
+func newCatalogStripper(logger *log.Logger) *catalogStripper {
+	return &catalogStripper{log: logger, nodes: make(map[string]bool)}
+}
+
+// resourceSize is the size of the parameters of a catalog resource.
+type resourceSize struct {
+	resource string
+	size     int
+}
+
+// strip replaces the parameter values larger than the configured limit by
+// a marker with their SHA-256 and length, and reports the largest resources
+// of the catalog when it does.
+func (s *catalogStripper) strip(c *v4Catalog) {
+	cfg := conf().CatalogSize
+	s.forget(c.Certname)
+	if cfg.MaxValueSize <= 0 {
+		return
+	}
+
+	var sizes []resourceSize
+	var stripped, strippedBytes int
+	for i := range c.Resources {
+		res := &c.Resources[i]
+		sizes = append(sizes, resourceSize{resource: res.Type + "[" + res.Title + "]", size: len(res.Parameters)})
+		// No value can be over the limit if all of them are not.
+		if len(res.Parameters) <= cfg.MaxValueSize {
+			continue
+		}
+		var params map[string]json.RawMessage
+		if err := json.Unmarshal(res.Parameters, &params); err != nil {
+			continue
+		}
+		var changed bool
+		for name, value := range params {
+			if len(value) <= cfg.MaxValueSize {
+				continue
+			}
+			params[name] = sizeMarker(value)
+			stripped++
+			strippedBytes += len(value)
+			changed = true
+		}
+		if changed {
+			res.Parameters, _ = json.Marshal(params)
+		}
+	}
+	if stripped == 0 {
+		return
+	}
+	catalogValuesStripped.Add(float64(stripped))
+	catalogBytesStripped.Add(float64(strippedBytes))
+
+	sort.Slice(sizes, func(i, j int) bool {
+		return sizes[i].size > sizes[j].size
+	})
+	if cfg.TopResources > 0 && len(sizes) > cfg.TopResources {
+		sizes = sizes[:cfg.TopResources]
+	}
+	var largest []string
+	for _, r := range sizes {
+		largest = append(largest, fmt.Sprintf("%s %d bytes", r.resource, r.size))
+	}
+	s.observe(c.Certname, sizes[0].size, cfg.MaxNodes)
+
+	msg := fmt.Sprintf("stripped %d parameter values of %d bytes over %d bytes, largest resources: %s",
+		stripped, strippedBytes, cfg.MaxValueSize, strings.Join(largest, ", "))
+	if s != nil {
+		s.log.Warnf("catalog of %s: %s", c.Certname, msg)
+	}
+	traces.tracef(c.Certname, "catalog %s", msg)
+}
+
+// observe exports the size of the largest resource of the node, for at
+// most maxNodes nodes (no limit if 0).
+func (s *catalogStripper) observe(certname string, size, maxNodes int) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.nodes[certname] && maxNodes > 0 && len(s.nodes) >= maxNodes {
+		return
+	}
+	s.nodes[certname] = true
+	catalogLargestResource.WithLabelValues(certname).Set(float64(size))
+}
+
+// forget removes the largest resource series of the node, e.g. when it is
+// deactivated or sends a catalog without large values.
+func (s *catalogStripper) forget(certname string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.nodes[certname] {
+		delete(s.nodes, certname)
+		catalogLargestResource.DeleteLabelValues(certname)
+	}
+}
+
+// sizeMarker replaces a parameter value too large for PuppetDB. The hash
+// and length of a string are of its content, so the hash of a file content
+// matches the checksum Puppet reports. Other values are re-encoded first,
+// so they don't depend on how the agent formatted them.
+func sizeMarker(value json.RawMessage) json.RawMessage {
+	var b []byte
+	var s string
+	if err := json.Unmarshal(value, &s); err == nil {
+		b = []byte(s)
+	} else {
+		b = canonicalJSON(value)
+	}
+	sum := sha256.Sum256(b)
+	j, _ := json.Marshal(fmt.Sprintf("[STRIPPED sha256:%s length:%d]", hex.EncodeToString(sum[:]), len(b)))
+	return j
+}
+
+// canonicalJSON re-encodes the value without spaces and with sorted keys,
+// keeping numbers as they are. Invalid values are returned as they are.
+func canonicalJSON(value json.RawMessage) []byte {
+	d := json.NewDecoder(bytes.NewReader(value))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return value
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return value
+	}
+	return j
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestSizeMarker(t *testing.T) {
+	a := sizeMarker([]byte(`{"b": [1, 2.50], "a": "x"}`))
+	b := sizeMarker([]byte(`{"a":"x","b":[1,2.50]}`))
+	if string(a) != string(b) {
+		t.Errorf("same value formatted differently gives %s and %s", a, b)
+	}
+	if c := sizeMarker([]byte(`{"a":"y","b":[1,2.50]}`)); string(c) == string(a) {
+		t.Errorf("different values give the same marker %s", c)
+	}
+
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{
+			name:  "string content",
+			value: `"hello\n"`,
+			want:  `"[STRIPPED sha256:5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03 length:6]"`,
+		},
+		{
+			name:  "escaped unicode",
+			value: `"caf\u00e9"`,
+			want:  `"[STRIPPED sha256:850f7dc43910ff890f8879c0ed26fe697c93a067ad93a7d50f466a7028a9bf4e length:5]"`,
+		},
+		{
+			name:  "array",
+			value: `[ "a", 1 ]`,
+			want:  `"[STRIPPED sha256:135f17a475a61afdeeaf3759ad2e45ad1c7abb192395abe47e41fc8e395dc1a9 length:7]"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sizeMarker([]byte(tt.value)); string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCatalogStripperMaxNodes(t *testing.T) {
+	setConfig(&config{CatalogSize: catalogSizeConfig{MaxValueSize: 10, MaxNodes: 1}})
+	logger := log.New()
+	logger.Out = ioutil.Discard
+	s := newCatalogStripper(logger)
+
+	params := `{"content":"a long file content"}`
+	for _, certname := range []string{"a.example.com", "b.example.com"} {
+		c := &v4Catalog{
+			Certname:  certname,
+			Resources: catalogResources{{Type: "File", Title: "/etc/motd", Parameters: []byte(params)}},
+		}
+		s.strip(c)
+		if string(c.Resources[0].Parameters) == params {
+			t.Errorf("catalog of %s not stripped", certname)
+		}
+	}
+	if len(s.nodes) != 1 || !s.nodes["a.example.com"] {
+		t.Errorf("got nodes %v, want a.example.com only", s.nodes)
+	}
+	s.forget("a.example.com")
+	if len(s.nodes) != 0 {
+		t.Errorf("got nodes %v after forget", s.nodes)
+	}
+}
@@ -20,6 +20,8 @@ type v4Commands struct {
 	Command string          `json:"command"`
 	Version int             `json:"version"`
 	Payload json.RawMessage `json:"payload"`
+	// Report is the converted store report command, nil for other commands.
+	Report *v4Report `json:"-"`
 }
 
 type v4CommandsFact struct {
@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"gopkg.in/yaml.v2"
+)
+
+// config holds all settings of the proxy. It is built from the command line
+// options, and the configuration file (--config) overrides the keys it sets.
+// The current config is replaced as a whole on reload and must not be
+// modified after it is stored.
+type config struct {
+	ListenAddress     string                  `yaml:"listen_address" json:"listen_address"`
+	ListenPort        int                     `yaml:"listen_port" json:"listen_port"`
+	Server            serverConfig            `yaml:"server" json:"server"`
+	PuppetDB          puppetDBConfig          `yaml:"puppetdb" json:"puppetdb"`
+	Environment       string                  `yaml:"environment" json:"environment"`
+	Producer          string                  `yaml:"producer" json:"producer"`
+	Rewrite           []rewriteRule           `yaml:"rewrite" json:"rewrite"`
+	ACL               []string                `yaml:"acl" json:"acl"`
+	Log               logConfig               `yaml:"log" json:"log"`
+	Trace             []string                `yaml:"trace" json:"trace"`
+	Dump              dumpConfig              `yaml:"dump" json:"dump"`
+	DeadLetterDir     string                  `yaml:"deadletter_dir" json:"deadletter_dir"`
+	Admin             adminConfig             `yaml:"admin" json:"admin"`
+	Health            healthConfig            `yaml:"health" json:"health"`
+	NodeMetrics       nodeMetricsConfig       `yaml:"node_metrics" json:"node_metrics"`
+	CorrectiveChange  correctiveChangeConfig  `yaml:"corrective_change" json:"corrective_change"`
+	CatalogUUIDs      catalogUUIDsConfig      `yaml:"catalog_uuids" json:"catalog_uuids"`
+	ReportResources   reportResourcesConfig   `yaml:"report_resources" json:"report_resources"`
+	CatalogValidation catalogValidationConfig `yaml:"catalog_validation" json:"catalog_validation"`
+	Redact            []redactionRule         `yaml:"redact" json:"redact"`
+	CatalogSize       catalogSizeConfig       `yaml:"catalog_size" json:"catalog_size"`
+	Facts             []factRule              `yaml:"facts" json:"facts"`
+	Stream            streamConfig            `yaml:"stream" json:"stream"`
+	Alerts            alertsConfig            `yaml:"alerts" json:"alerts"`
+	Sinks             []sinkConfig            `yaml:"sinks" json:"sinks"`
+
+	client *http.Client
+	acl    []*net.IPNet
+	// redactions are the validated Redact rules.
+	redactions []redaction
+	// factRules are the validated Facts rules.
+	factRules []factPipeline
+}
+
+type serverConfig struct {
+	ReadTimeout     time.Duration `yaml:"read_timeout" json:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout" json:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout" json:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+}
+
+type healthConfig struct {
+	CacheTTL        time.Duration `yaml:"cache_ttl" json:"cache_ttl"`
+	Timeout         time.Duration `yaml:"timeout" json:"timeout"`
+	MinFreeBytes    uint64        `yaml:"min_free_bytes" json:"min_free_bytes"`
+	SpoolMaxEntries int           `yaml:"spool_max_entries" json:"spool_max_entries"`
+}
+
+// streamConfig applies to new stream subscribers, Buffer is the number of
+// events kept for a slow subscriber before dropping them.
+type streamConfig struct {
+	Buffer         int           `yaml:"buffer" json:"buffer"`
+	MaxSubscribers int           `yaml:"max_subscribers" json:"max_subscribers"`
+	Keepalive      time.Duration `yaml:"keepalive" json:"keepalive"`
+}
+
+// alertsConfig sets up webhook alerts on run outcomes of the nodes matching
+// the certname globs (all nodes if empty).
+type alertsConfig struct {
+	Webhooks            []alertWebhook `yaml:"webhooks" json:"webhooks"`
+	Certnames           []string       `yaml:"certnames" json:"certnames"`
+	ConsecutiveFailures int            `yaml:"consecutive_failures" json:"consecutive_failures"`
+	NotReportingAfter   time.Duration  `yaml:"not_reporting_after" json:"not_reporting_after"`
+	CheckInterval       time.Duration  `yaml:"check_interval" json:"check_interval"`
+	DedupWindow         time.Duration  `yaml:"dedup_window" json:"dedup_window"`
+	Retries             int            `yaml:"retries" json:"retries"`
+	RetryInterval       time.Duration  `yaml:"retry_interval" json:"retry_interval"`
+	MaxRetryTime        time.Duration  `yaml:"max_retry_time" json:"max_retry_time"`
+	Timeout             time.Duration  `yaml:"timeout" json:"timeout"`
+	MaxNodes            int            `yaml:"max_nodes" json:"max_nodes"`
+}
+
+// alertWebhook receives the alerts of Triggers (all if empty), with the body
+// rendered by Template (the alert as JSON if empty).
+type alertWebhook struct {
+	URL      string            `yaml:"url" json:"url"`
+	Headers  map[string]string `yaml:"headers" json:"-"`
+	Triggers []string          `yaml:"triggers" json:"triggers"`
+	Template string            `yaml:"template" json:"template"`
+}
+
+// sinkConfig is an output for the converted commands besides PuppetDB.
+// Commands are short command names (all if empty), the other fields depend
+// on the type.
+type sinkConfig struct {
+	Name          string            `yaml:"name" json:"name"`
+	Type          string            `yaml:"type" json:"type"`
+	Commands      []string          `yaml:"commands" json:"commands"`
+	Buffer        int               `yaml:"buffer" json:"buffer"`
+	FlushInterval time.Duration     `yaml:"flush_interval" json:"flush_interval"`
+	Path          string            `yaml:"path" json:"path,omitempty"`
+	URL           string            `yaml:"url" json:"url,omitempty"`
+	Headers       map[string]string `yaml:"headers" json:"-"`
+	BatchSize     int               `yaml:"batch_size" json:"batch_size,omitempty"`
+	Timeout       time.Duration     `yaml:"timeout" json:"timeout,omitempty"`
+	Insecure      bool              `yaml:"insecure" json:"insecure,omitempty"`
+	CAFile        string            `yaml:"ca_file" json:"ca_file,omitempty"`
+	CertFile      string            `yaml:"cert_file" json:"cert_file,omitempty"`
+	KeyFile       string            `yaml:"key_file" json:"key_file,omitempty"`
+	Address       string            `yaml:"address" json:"address,omitempty"`
+	Protocol      string            `yaml:"protocol" json:"protocol,omitempty"`
+	Template      string            `yaml:"template" json:"template,omitempty"`
+}
+
+// nodeMetricsConfig limits the per node run metrics to the certname globs
+// (all nodes if empty) and to at most MaxNodes nodes (no limit if 0).
+type nodeMetricsConfig struct {
+	Enabled   bool     `yaml:"enabled" json:"enabled"`
+	Certnames []string `yaml:"certnames" json:"certnames"`
+	MaxNodes  int      `yaml:"max_nodes" json:"max_nodes"`
+}
+
+// correctiveChangeConfig enables the detection of corrective changes from
+// the catalogs of at most MaxNodes nodes (no limit if 0).
+type correctiveChangeConfig struct {
+	Enabled  bool `yaml:"enabled" json:"enabled"`
+	MaxNodes int  `yaml:"max_nodes" json:"max_nodes"`
+}
+
+// catalogUUIDsConfig keeps the catalog UUIDs of the last MaxEntries
+// catalogs (disabled if 0), saved to File if set.
+type catalogUUIDsConfig struct {
+	MaxEntries int    `yaml:"max_entries" json:"max_entries"`
+	File       string `yaml:"file" json:"file"`
+}
+
+// reportResourcesConfig enables completing the reports with the resources
+// of the last catalog of at most MaxNodes nodes, skipping catalogs of more
+// than MaxResources resources (no limits if 0).
+type reportResourcesConfig struct {
+	Enabled      bool `yaml:"enabled" json:"enabled"`
+	MaxNodes     int  `yaml:"max_nodes" json:"max_nodes"`
+	MaxResources int  `yaml:"max_resources" json:"max_resources"`
+}
+
+// catalogSizeConfig replaces catalog parameter values over MaxValueSize
+// bytes (disabled if 0), logs the TopResources largest resources of such
+// catalogs and exports the largest one for at most MaxNodes nodes (no limit
+// if 0).
+type catalogSizeConfig struct {
+	MaxValueSize int `yaml:"max_value_size" json:"max_value_size"`
+	TopResources int `yaml:"top_resources" json:"top_resources"`
+	MaxNodes     int `yaml:"max_nodes" json:"max_nodes"`
+}
+
+// catalogValidationConfig is the action on problems found in catalogs:
+// repair, reject or ignore. Findings overrides Policy for some findings.
+type catalogValidationConfig struct {
+	Policy   string            `yaml:"policy" json:"policy"`
+	Findings map[string]string `yaml:"findings" json:"findings"`
+}
+
+type puppetDBConfig struct {
+	// URLs are tried in order until one of them answers.
+	URLs     []string `yaml:"urls" json:"urls"`
+	Insecure bool     `yaml:"insecure" json:"insecure"`
+	CAFile   string   `yaml:"ca_file" json:"ca_file"`
+	CertFile string   `yaml:"cert_file" json:"cert_file"`
+	KeyFile  string   `yaml:"key_file" json:"key_file"`
+}
+
+// rewriteRule sets the environment and producer of commands from nodes
+// matching the certname glob. The first matching rule wins.
+type rewriteRule struct {
+	Certname    string `yaml:"certname" json:"certname"`
+	Environment string `yaml:"environment" json:"environment,omitempty"`
+	Producer    string `yaml:"producer" json:"producer,omitempty"`
+}
+
+type logConfig struct {
+	File  string `yaml:"file" json:"file"`
+	Level int    `yaml:"level" json:"level"`
+}
+
+type adminConfig struct {
+	Address string `yaml:"address" json:"address"`
+	Token   string `yaml:"token" json:"-"`
+}
+
+// restartFields are the config fields that are only applied on restart.
+var restartFields = map[string]bool{
+	"ListenAddress":       true,
+	"ListenPort":          true,
+	"Server.ReadTimeout":  true,
+	"Server.WriteTimeout": true,
+	"Server.IdleTimeout":  true,
+	"Log.File":            true,
+	"DeadLetterDir":       true,
+	"Admin.Address":       true,
+	"Sinks":               true,
+	"CatalogUUIDs.File":   true,
+}
+
+var currentConfig atomic.Value
+
+// conf returns the current config.
+func conf() *config {
+	return currentConfig.Load().(*config)
+}
+
+func setConfig(c *config) {
+	currentConfig.Store(c)
+}
+
+// configFromOpts returns the config given by the command line options.
+func configFromOpts() *config {
+	c := new(config)
+	c.ListenAddress = opts.ListenAddress
+	c.ListenPort = opts.ListenPort
+	c.Server.ReadTimeout = opts.ReadTimeout
+	c.Server.WriteTimeout = opts.WriteTimeout
+	c.Server.IdleTimeout = opts.IdleTimeout
+	c.Server.ShutdownTimeout = opts.ShutdownTimeout
+	c.PuppetDB.URLs = []string{opts.PuppetDBURL}
+	c.PuppetDB.Insecure = opts.Insecure
+	c.PuppetDB.CAFile = opts.PuppetDBCA
+	c.PuppetDB.CertFile = opts.PuppetDBCert
+	c.PuppetDB.KeyFile = opts.PuppetDBKey
+	c.Environment = opts.Environment
+	c.Producer = opts.Producer
+	c.Log.File = opts.LogFile
+	c.Log.Level = opts.LogLevel
+	c.Dump.Dir = opts.DumpDir
+	c.Dump.MaxSize = opts.DumpMaxSize
+	c.Dump.Retention = opts.DumpRetention
+	c.Dump.Targets = opts.DumpHostname
+	if opts.DumpFacts {
+		c.Dump.Commands = append(c.Dump.Commands, "facts")
+	}
+	if opts.DumpCatalog {
+		c.Dump.Commands = append(c.Dump.Commands, "catalog")
+	}
+	if opts.DumpReport {
+		c.Dump.Commands = append(c.Dump.Commands, "report")
+	}
+	if opts.DumpDeactivate {
+		c.Dump.Commands = append(c.Dump.Commands, "deactivate")
+	}
+	if opts.DumpQuery {
+		c.Dump.Commands = append(c.Dump.Commands, dumpQuery)
+	}
+	c.DeadLetterDir = opts.DeadLetterDir
+	c.Admin.Address = opts.AdminAddress
+	c.Admin.Token = opts.AdminToken
+	c.Health.CacheTTL = opts.HealthCacheTTL
+	c.Health.Timeout = opts.HealthTimeout
+	c.Health.MinFreeBytes = opts.HealthMinFreeBytes
+	c.Health.SpoolMaxEntries = opts.HealthSpoolMaxEntries
+	c.NodeMetrics.Enabled = opts.NodeMetrics
+	c.NodeMetrics.Certnames = opts.NodeMetricsCertnames
+	c.NodeMetrics.MaxNodes = opts.NodeMetricsMaxNodes
+	c.CorrectiveChange.Enabled = opts.CorrectiveChange
+	c.CorrectiveChange.MaxNodes = opts.CorrectiveChangeMaxNodes
+	c.CatalogUUIDs.MaxEntries = opts.CatalogUUIDsMax
+	c.CatalogUUIDs.File = opts.CatalogUUIDsFile
+	c.ReportResources.Enabled = opts.ReportResources
+	c.ReportResources.MaxNodes = opts.ReportResourcesMaxNodes
+	c.ReportResources.MaxResources = opts.ReportResourcesMaxCount
+	c.CatalogValidation.Policy = opts.CatalogValidation
+	c.CatalogSize.MaxValueSize = opts.CatalogMaxValueSize
+	if len(opts.FactsExclude) > 0 {
+		c.Facts = append(c.Facts, factRule{Exclude: opts.FactsExclude})
+	}
+	if opts.FactsCoerce {
+		c.Facts = append(c.Facts, factRule{Coerce: factCoercion{Known: true}})
+	}
+	c.CatalogSize.TopResources = opts.CatalogTopResources
+	c.CatalogSize.MaxNodes = opts.CatalogSizeMaxNodes
+	c.Stream.Buffer = opts.StreamBuffer
+	c.Stream.MaxSubscribers = opts.StreamMaxSubscribers
+	c.Stream.Keepalive = opts.StreamKeepalive
+	for _, u := range opts.AlertsWebhooks {
+		c.Alerts.Webhooks = append(c.Alerts.Webhooks, alertWebhook{URL: u})
+	}
+	c.Alerts.ConsecutiveFailures = opts.AlertsConsecutiveFailures
+	c.Alerts.NotReportingAfter = opts.AlertsNotReportingAfter
+	c.Alerts.CheckInterval = time.Minute
+	c.Alerts.DedupWindow = opts.AlertsDedupWindow
+	c.Alerts.Retries = opts.AlertsRetries
+	c.Alerts.RetryInterval = 10 * time.Second
+	c.Alerts.MaxRetryTime = 5 * time.Minute
+	c.Alerts.Timeout = 10 * time.Second
+	c.Alerts.MaxNodes = 10000
+	if opts.SinkFile != "" {
+		c.Sinks = append(c.Sinks, sinkConfig{Type: sinkFile, Path: opts.SinkFile})
+	}
+	if opts.ForemanURL != "" {
+		c.Sinks = append(c.Sinks, sinkConfig{
+			Type:     sinkForeman,
+			URL:      opts.ForemanURL,
+			CAFile:   opts.ForemanCA,
+			CertFile: opts.ForemanCert,
+			KeyFile:  opts.ForemanKey,
+		})
+	}
+	if opts.StatsDAddress != "" {
+		c.Sinks = append(c.Sinks, sinkConfig{Type: sinkStatsD, Address: opts.StatsDAddress, Template: opts.MetricTemplate})
+	}
+	if opts.GraphiteAddress != "" {
+		c.Sinks = append(c.Sinks, sinkConfig{Type: sinkGraphite, Address: opts.GraphiteAddress, Template: opts.MetricTemplate})
+	}
+	if opts.SinkStdout {
+		c.Sinks = append(c.Sinks, sinkConfig{Type: sinkStdout})
+	}
+
+	return c
+}
+
+// loadConfig builds and validates a new config from the command line options
+// and the configuration file.
+func loadConfig() (*config, error) {
+	c := configFromOpts()
+	if opts.ConfigFile != "" {
+		b, err := ioutil.ReadFile(opts.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.UnmarshalStrict(b, c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", opts.ConfigFile, err)
+		}
+	}
+	if err := c.init(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// init validates the config and prepares its derived fields.
+func (c *config) init() error {
+	if len(c.PuppetDB.URLs) == 0 {
+		return fmt.Errorf("no PuppetDB URL configured")
+	}
+	for i, u := range c.PuppetDB.URLs {
+		c.PuppetDB.URLs[i] = strings.TrimSuffix(u, "/")
+	}
+	if c.Log.Level < int(log.PanicLevel) || c.Log.Level > int(log.TraceLevel) {
+		return fmt.Errorf("invalid log level %d", c.Log.Level)
+	}
+	for _, r := range c.Rewrite {
+		if err := checkPattern(r.Certname); err != nil {
+			return err
+		}
+	}
+	patterns := append(append([]string{}, c.Trace...), c.Dump.Targets...)
+	patterns = append(patterns, c.NodeMetrics.Certnames...)
+	for _, p := range append(patterns, c.Alerts.Certnames...) {
+		if err := checkPattern(p); err != nil {
+			return err
+		}
+	}
+	for _, cmd := range c.Dump.Commands {
+		switch cmd {
+		case "facts", "catalog", "report", "deactivate", dumpQuery:
+		default:
+			return fmt.Errorf("unknown dump command %q", cmd)
+		}
+	}
+	if err := c.CatalogValidation.check(); err != nil {
+		return err
+	}
+	if c.Stream.Buffer < 0 {
+		return fmt.Errorf("invalid stream buffer %d", c.Stream.Buffer)
+	}
+	if c.Stream.Keepalive <= 0 {
+		return fmt.Errorf("invalid stream keepalive %s", c.Stream.Keepalive)
+	}
+	if err := c.Alerts.check(); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for i := range c.Sinks {
+		s := &c.Sinks[i]
+		if err := s.init(); err != nil {
+			return err
+		}
+		if names[s.Name] {
+			return fmt.Errorf("duplicate sink name %q", s.Name)
+		}
+		names[s.Name] = true
+	}
+	if c.Admin.Address != "" && c.Admin.Token == "" {
+		return fmt.Errorf("admin API requires a token")
+	}
+
+	for _, a := range c.ACL {
+		if !strings.Contains(a, "/") {
+			if ip := net.ParseIP(a); ip != nil && ip.To4() == nil {
+				a += "/128"
+			} else {
+				a += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(a)
+		if err != nil {
+			return fmt.Errorf("invalid ACL entry: %v", err)
+		}
+		c.acl = append(c.acl, n)
+	}
+
+	rules := make(map[string]bool)
+	for i := range c.Redact {
+		r, err := c.Redact[i].init(i)
+		if err != nil {
+			return err
+		}
+		if rules[r.Name] {
+			return fmt.Errorf("duplicate redaction rule %s", r.Name)
+		}
+		rules[r.Name] = true
+		c.redactions = append(c.redactions, r)
+	}
+
+	for i := range c.Facts {
+		p, err := c.Facts[i].init(i)
+		if err != nil {
+			return err
+		}
+		c.factRules = append(c.factRules, p)
+	}
+
+	tlsConfig, err := c.PuppetDB.tlsConfig()
+	if err != nil {
+		return err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c.client = &http.Client{Transport: transport}
+
+	return nil
+}
+
+func (p puppetDBConfig) tlsConfig() (*tls.Config, error) {
+	return newTLSConfig(p.Insecure, p.CAFile, p.CertFile, p.KeyFile)
+}
+
+func (s sinkConfig) tlsConfig() (*tls.Config, error) {
+	return newTLSConfig(s.Insecure, s.CAFile, s.CertFile, s.KeyFile)
+}
+
+// newTLSConfig returns a client TLS config verifying the server with the CA
+// certificate and authenticating with the client certificate, if set.
+func newTLSConfig(insecure bool, caFile, certFile, keyFile string) (*tls.Config, error) {
+	t := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		ca, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		t.RootCAs = x509.NewCertPool()
+		if !t.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		t.Certificates = []tls.Certificate{cert}
+	}
+
+	return t, nil
+}
+
+// rewrite returns the environment and producer for commands of the node.
+func (c *config) rewrite(certname string) (environment, producer string) {
+	environment, producer = c.Environment, c.Producer
+	for _, r := range c.Rewrite {
+		if ok, _ := path.Match(r.Certname, certname); !ok {
+			continue
+		}
+		if r.Environment != "" {
+			environment = r.Environment
+		}
+		if r.Producer != "" {
+			producer = r.Producer
+		}
+		break
+	}
+
+	return environment, producer
+}
+
+// allowed reports whether the ACL allows requests from the remote address.
+func (c *config) allowed(remoteAddr string) bool {
+	if len(c.acl) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.acl {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// configDiff returns the names of changed fields with their old and new values.
+func configDiff(a, b *config) []string {
+	var diff []string
+	diffFields("", reflect.ValueOf(*a), reflect.ValueOf(*b), &diff)
+	return diff
+}
+
+func diffFields(prefix string, a, b reflect.Value, diff *[]string) {
+	t := a.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		name := prefix + f.Name
+		va, vb := a.Field(i), b.Field(i)
+		if reflect.DeepEqual(va.Interface(), vb.Interface()) {
+			continue
+		}
+		if f.Type.Kind() == reflect.Struct {
+			diffFields(name+".", va, vb, diff)
+			continue
+		}
+		if f.Tag.Get("json") == "-" {
+			*diff = append(*diff, name+" changed")
+			continue
+		}
+		*diff = append(*diff, fmt.Sprintf("%s: %s -> %s", name, diffValue(va), diffValue(vb)))
+	}
+}
+
+func diffValue(v reflect.Value) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v.Interface())
+	return strings.TrimSpace(b.String())
+}
+
+// reload reads the configuration file again and applies it. On error the
+// current config is kept.
+func (s *server) reload() {
+	c, err := loadConfig()
+	if err != nil {
+		s.Log.Errorf("failed to reload config, keeping the current one: %v", err)
+		return
+	}
+	old := conf()
+	diff := configDiff(old, c)
+	if len(diff) == 0 {
+		s.Log.Info("config reloaded, nothing changed")
+		return
+	}
+
+	setConfig(c)
+	s.Log.SetLevel(log.Level(c.Log.Level))
+	traces.set(c.Trace)
+	dumps.set(c.Dump)
+	nodeRuns.prune()
+	catalogHistory.prune()
+	lastCatalogs.prune()
+
+	for _, d := range diff {
+		name := strings.SplitN(d, ":", 2)[0]
+		name = strings.TrimSuffix(name, " changed")
+		if restartFields[name] {
+			s.Log.Warnf("config changed: %s (applied on restart)", d)
+			continue
+		}
+		s.Log.Infof("config changed: %s", d)
+	}
+}
+
+// check validates the webhooks and their templates.
+func (c alertsConfig) check() error {
+	for _, w := range c.Webhooks {
+		u, err := url.Parse(w.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid alert webhook URL %q", w.URL)
+		}
+		for _, t := range w.Triggers {
+			if !contains(alertTriggers, t) {
+				return fmt.Errorf("unknown alert trigger %q", t)
+			}
+		}
+		if _, err := parseAlertTemplate(w.Template); err != nil {
+			return fmt.Errorf("invalid template of alert webhook %s: %v", w.URL, err)
+		}
+	}
+	if c.CheckInterval <= 0 || c.RetryInterval <= 0 || c.MaxRetryTime <= 0 || c.Timeout <= 0 {
+		return fmt.Errorf("alert check_interval, retry_interval, max_retry_time and timeout must be positive")
+	}
+	return nil
+}
+
+// init validates the sink and sets the defaults of unset fields.
+func (s *sinkConfig) init() error {
+	if !contains(sinkTypes, s.Type) {
+		return fmt.Errorf("unknown sink type %q", s.Type)
+	}
+	if s.Name == "" {
+		s.Name = s.Type
+	}
+	for _, cmd := range s.Commands {
+		switch cmd {
+		case "facts", "catalog", "report", "deactivate":
+		default:
+			return fmt.Errorf("unknown command %q of sink %s", cmd, s.Name)
+		}
+	}
+	if s.Buffer <= 0 {
+		s.Buffer = 1000
+	}
+	if s.FlushInterval <= 0 {
+		s.FlushInterval = 5 * time.Second
+	}
+
+	switch s.Type {
+	case sinkFile:
+		if s.Path == "" {
+			return fmt.Errorf("sink %s requires a path", s.Name)
+		}
+	case sinkStatsD, sinkGraphite:
+		if s.Address == "" {
+			return fmt.Errorf("sink %s requires an address", s.Name)
+		}
+		if s.Protocol == "" {
+			s.Protocol = "udp"
+			if s.Type == sinkGraphite {
+				s.Protocol = "tcp"
+			}
+		}
+		if s.Protocol != "udp" && s.Protocol != "tcp" {
+			return fmt.Errorf("invalid protocol %q of sink %s", s.Protocol, s.Name)
+		}
+		if _, err := parseMetricTemplate(s.Template); err != nil {
+			return fmt.Errorf("invalid template of sink %s: %v", s.Name, err)
+		}
+		if s.Timeout <= 0 {
+			s.Timeout = 5 * time.Second
+		}
+		return s.reportsOnly()
+	case sinkForeman:
+		if err := s.reportsOnly(); err != nil {
+			return err
+		}
+		fallthrough
+	case sinkHTTP:
+		u, err := url.Parse(s.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid URL %q of sink %s", s.URL, s.Name)
+		}
+		if s.BatchSize <= 0 {
+			s.BatchSize = 100
+		}
+		if s.Timeout <= 0 {
+			s.Timeout = 10 * time.Second
+		}
+	}
+	return nil
+}
+
+// reportsOnly limits the sink to reports, the only command it can handle.
+func (s *sinkConfig) reportsOnly() error {
+	if len(s.Commands) == 0 {
+		s.Commands = []string{"report"}
+	}
+	if len(s.Commands) != 1 || s.Commands[0] != "report" {
+		return fmt.Errorf("sink %s accepts reports only", s.Name)
+	}
+	return nil
+}
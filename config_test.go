@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/jessevdk/go-flags"
+)
+
+// TestMain sets the options to their defaults, as if no flag was given.
+func TestMain(m *testing.M) {
+	if _, err := flags.NewParser(&opts, flags.Default).ParseArgs(nil); err != nil {
+		os.Exit(2)
+	}
+	os.Exit(m.Run())
+}
+
+// setTestConfig makes the config given by the default options current,
+// with the fields set in c.
+func setTestConfig(t *testing.T, c *config) {
+	d := configFromOpts()
+	overlay(reflect.ValueOf(d).Elem(), reflect.ValueOf(c).Elem())
+	if err := d.init(); err != nil {
+		t.Fatal(err)
+	}
+	setConfig(d)
+}
+
+// overlay sets the non-zero fields of src in dst, recursing into structs.
+func overlay(dst, src reflect.Value) {
+	for i := 0; i < src.NumField(); i++ {
+		if src.Type().Field(i).PkgPath != "" {
+			continue
+		}
+		f := src.Field(i)
+		if f.Kind() == reflect.Struct {
+			overlay(dst.Field(i), f)
+			continue
+		}
+		if !f.IsZero() {
+			dst.Field(i).Set(f)
+		}
+	}
+}
+
+// writeTestConfig writes a configuration file and points --config at it.
+func writeTestConfig(t *testing.T, content string) func() {
+	f, err := ioutil.TempFile("", "puppetdb-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(content)
+	f.Close()
+	old := opts.ConfigFile
+	opts.ConfigFile = f.Name()
+	return func() {
+		opts.ConfigFile = old
+		os.Remove(f.Name())
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+		check   func(c *config) bool
+	}{
+		{
+			name:    "keys override options",
+			content: "puppetdb:\n  urls: [\"http://pdb1:8080/\", \"http://pdb2:8080\"]\nenvironment: staging\n",
+			check: func(c *config) bool {
+				return reflect.DeepEqual(c.PuppetDB.URLs, []string{"http://pdb1:8080", "http://pdb2:8080"}) &&
+					c.Environment == "staging" && c.ListenPort == opts.ListenPort
+			},
+		},
+		{
+			name:    "unknown key",
+			content: "enviroment: staging\n",
+			wantErr: "enviroment",
+		},
+		{
+			name:    "invalid trace pattern",
+			content: "trace: [\"[web\"]\n",
+			wantErr: "invalid certname pattern",
+		},
+		{
+			name:    "unknown dump command",
+			content: "dump:\n  commands: [inventory]\n",
+			wantErr: "unknown dump command",
+		},
+		{
+			name:    "admin API without token",
+			content: "admin:\n  address: 127.0.0.1:8089\n",
+			wantErr: "requires a token",
+		},
+		{
+			name:    "invalid ACL entry",
+			content: "acl: [\"10.0.0.0/33\"]\n",
+			wantErr: "invalid ACL entry",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer writeTestConfig(t, tt.content)()
+			c, err := loadConfig()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !tt.check(c) {
+				t.Errorf("unexpected config %+v", c)
+			}
+		})
+	}
+}
+
+func TestConfigRewrite(t *testing.T) {
+	c := &config{
+		Environment: "production",
+		Producer:    "puppet.example.com",
+		Rewrite: []rewriteRule{
+			{Certname: "*.staging.example.com", Environment: "staging"},
+			{Certname: "legacy-*", Producer: "puppet-legacy.example.com"},
+			{Certname: "legacy-*", Environment: "never"},
+		},
+	}
+	tests := []struct {
+		certname        string
+		wantEnvironment string
+		wantProducer    string
+	}{
+		{"web01.example.com", "production", "puppet.example.com"},
+		{"web01.staging.example.com", "staging", "puppet.example.com"},
+		{"legacy-web01.example.com", "production", "puppet-legacy.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.certname, func(t *testing.T) {
+			environment, producer := c.rewrite(tt.certname)
+			if environment != tt.wantEnvironment || producer != tt.wantProducer {
+				t.Errorf("got %s, %s, want %s, %s", environment, producer, tt.wantEnvironment, tt.wantProducer)
+			}
+		})
+	}
+}
+
+func TestConfigAllowed(t *testing.T) {
+	tests := []struct {
+		name       string
+		acl        []string
+		remoteAddr string
+		want       bool
+	}{
+		{"no ACL", nil, "192.0.2.1:5000", true},
+		{"single address", []string{"192.0.2.1"}, "192.0.2.1:5000", true},
+		{"other address", []string{"192.0.2.1"}, "192.0.2.2:5000", false},
+		{"network", []string{"10.0.0.0/8"}, "10.1.2.3:5000", true},
+		{"IPv6 address", []string{"::1"}, "[::1]:5000", true},
+		{"invalid remote address", []string{"10.0.0.0/8"}, "unknown", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := configFromOpts()
+			c.ACL = tt.acl
+			if err := c.init(); err != nil {
+				t.Fatal(err)
+			}
+			if got := c.allowed(tt.remoteAddr); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigDiff(t *testing.T) {
+	a := &config{ListenPort: 8088, Environment: "production", Admin: adminConfig{Token: "a"}}
+	b := &config{ListenPort: 8089, Environment: "production", Admin: adminConfig{Token: "b"}}
+	want := []string{"ListenPort: 8088 -> 8089", "Admin.Token changed"}
+	if got := configDiff(a, b); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestReload(t *testing.T) {
+	s := new(server)
+	s.Log = log.New()
+	s.Log.Out = ioutil.Discard
+	traces = newTracer(s.Log)
+	dumps = newDumper(dumpConfig{})
+	defer func() { traces, dumps = nil, nil }()
+	setTestConfig(t, configFromOpts())
+
+	defer writeTestConfig(t, "trace: [\"web*\"]\n")()
+	s.reload()
+	if got := conf().Trace; !reflect.DeepEqual(got, []string{"web*"}) {
+		t.Fatalf("got trace %v after reload", got)
+	}
+	if !traces.match("web01.example.com") {
+		t.Error("trace targets not applied")
+	}
+
+	ioutil.WriteFile(opts.ConfigFile, []byte("trace: [\"[web\"]\n"), 0644)
+	s.reload()
+	if got := conf().Trace; !reflect.DeepEqual(got, []string{"web*"}) {
+		t.Errorf("got trace %v after a failed reload, want the previous config", got)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	correctiveEvents = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_corrective_change_events_total",
+			Help: "Report events flagged as corrective changes.",
+		},
+	)
+	correctiveNodesDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_corrective_change_nodes_dropped_total",
+			Help: "Catalogs not tracked for corrective changes because the node limit was reached.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(correctiveEvents)
+	prometheus.MustRegister(correctiveNodesDropped)
+}
+
+// catalogHistory detects corrective changes in reports from the catalogs of
+// the nodes. It is nil outside of the server.
+var catalogHistory *catalogTracker
+
+// catalogTracker keeps the parameters of the last catalog of every node,
+// and the resources that changed from the catalog before it.
+type catalogTracker struct {
+	mu    sync.Mutex
+	nodes map[string]*catalogNode
+}
+
+// catalogNode is the last catalog of a node. Parameter values are kept as
+// hashes, so the memory doesn't grow with the size of the values.
+type catalogNode struct {
+	transactionUUID string
+	params          map[string]map[string]uint64 // resource to parameter hashes
+	// changed holds the resources that are new or whose parameters changed
+	// from the previous catalog, nil if there was none.
+	changed map[string]bool
+}
+
+func newCatalogTracker() *catalogTracker {
+	return &catalogTracker{nodes: make(map[string]*catalogNode)}
+}
+
+// observe remembers the converted catalog and what changed from the
+// previous catalog of the node.
+func (t *catalogTracker) observe(c *v4Catalog) {
+	if t == nil || !conf().CorrectiveChange.Enabled {
+		return
+	}
+	params := catalogParams(c.Resources)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, ok := t.nodes[c.Certname]
+	if !ok {
+		if max := conf().CorrectiveChange.MaxNodes; max > 0 && len(t.nodes) >= max {
+			correctiveNodesDropped.Inc()
+			return
+		}
+		t.nodes[c.Certname] = &catalogNode{transactionUUID: c.TransactionUUID, params: params}
+		return
+	}
+	// A catalog submitted again, e.g. from the dead letter directory.
+	if n.transactionUUID == c.TransactionUUID {
+		return
+	}
+
+	changed := make(map[string]bool)
+	for resource, values := range params {
+		old, ok := n.params[resource]
+		if !ok || len(old) != len(values) {
+			changed[resource] = true
+			continue
+		}
+		for param, v := range values {
+			if ov, ok := old[param]; !ok || ov != v {
+				changed[resource] = true
+				break
+			}
+		}
+	}
+	n.transactionUUID = c.TransactionUUID
+	n.params = params
+	n.changed = changed
+}
+
+// mark flags the events of the report as corrective changes when none of
+// the parameters of their resource changed in the catalog of the run, i.e.
+// Puppet repaired a drift. Events don't map to parameters, e.g. a changed
+// file source gives a content event, so any parameter change counts.
+// Reports without the catalog of their transaction, or whose catalog has no
+// previous one, are left alone.
+func (t *catalogTracker) mark(r *v4Report) {
+	if t == nil || !conf().CorrectiveChange.Enabled {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n, ok := t.nodes[r.Certname]
+	if !ok || n.changed == nil || r.TransactionUUID == "" || n.transactionUUID != r.TransactionUUID {
+		return
+	}
+	for i := range r.Resources {
+		res := &r.Resources[i]
+		resource := res.ResourceType + "[" + res.ResourceTitle + "]"
+		if _, ok := n.params[resource]; !ok || n.changed[resource] {
+			continue
+		}
+		for j := range res.Events {
+			e := &res.Events[j]
+			if e.Status != "success" && e.Status != "noop" {
+				continue
+			}
+			e.CorrectiveChange = true
+			res.CorrectiveChange = true
+			r.CorrectiveChange = true
+			correctiveEvents.Inc()
+		}
+	}
+}
+
+// forget drops the catalog of the node, e.g. when it is deactivated.
+func (t *catalogTracker) forget(certname string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.nodes, certname)
+}
+
+// prune drops all catalogs when corrective change detection is disabled.
+func (t *catalogTracker) prune() {
+	if t == nil || conf().CorrectiveChange.Enabled {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nodes = make(map[string]*catalogNode)
+}
+
+// catalogParams hashes the parameter values of the catalog resources.
+func catalogParams(resources catalogResources) map[string]map[string]uint64 {
+	params := make(map[string]map[string]uint64, len(resources))
+	for _, res := range resources {
+		var values map[string]json.RawMessage
+		json.Unmarshal(res.Parameters, &values)
+		hashes := make(map[string]uint64, len(values))
+		for param, v := range values {
+			h := fnv.New64a()
+			h.Write(v)
+			hashes[param] = h.Sum64()
+		}
+		params[res.Type+"["+res.Title+"]"] = hashes
+	}
+	return params
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestCatalogTrackerMark(t *testing.T) {
+	setConfig(&config{CorrectiveChange: correctiveChangeConfig{Enabled: true}})
+
+	catalog := func(tx, source string) *v4Catalog {
+		return &v4Catalog{
+			Certname:        "web01.example.com",
+			TransactionUUID: tx,
+			Resources: catalogResources{
+				{Type: "File", Title: "/etc/motd", Parameters: []byte(`{"ensure":"file","source":"` + source + `"}`)},
+				{Type: "Service", Title: "ntpd", Parameters: []byte(`{"ensure":"running"}`)},
+			},
+		}
+	}
+	report := func(tx string) *v4Report {
+		return &v4Report{
+			Certname:        "web01.example.com",
+			TransactionUUID: tx,
+			Resources: v4Resources{
+				{ResourceType: "File", ResourceTitle: "/etc/motd", Events: []v4ResourceEventExpanded{{Status: "success", Property: "content"}}},
+				{ResourceType: "Service", ResourceTitle: "ntpd", Events: []v4ResourceEventExpanded{{Status: "success", Property: "ensure"}}},
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		source     string
+		motd, ntpd bool
+	}{
+		// The source change gives a content event, which is not a parameter.
+		{"changed source", "puppet:///modules/motd/new", false, true},
+		{"unchanged catalog", "puppet:///modules/motd/old", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newCatalogTracker()
+			tracker.observe(catalog("tx1", "puppet:///modules/motd/old"))
+			tracker.observe(catalog("tx2", tt.source))
+
+			r := report("tx2")
+			tracker.mark(r)
+			if got := r.Resources[0].Events[0].CorrectiveChange; got != tt.motd {
+				t.Errorf("File[/etc/motd] content event corrective %v, want %v", got, tt.motd)
+			}
+			if got := r.Resources[1].Events[0].CorrectiveChange; got != tt.ntpd {
+				t.Errorf("Service[ntpd] ensure event corrective %v, want %v", got, tt.ntpd)
+			}
+			if r.CorrectiveChange != (tt.motd || tt.ntpd) {
+				t.Errorf("report corrective %v", r.CorrectiveChange)
+			}
+		})
+	}
+
+	t.Run("other transaction", func(t *testing.T) {
+		tracker := newCatalogTracker()
+		tracker.observe(catalog("tx1", "a"))
+		tracker.observe(catalog("tx2", "a"))
+		r := report("tx3")
+		tracker.mark(r)
+		if r.CorrectiveChange {
+			t.Error("report of another transaction flagged as corrective")
+		}
+	})
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Stages at which a command can fail and end up in the dead-letter directory.
+const (
+	deadLetterStageConvert = "convert"
+	deadLetterStageSubmit  = "submit"
+)
+
+// deadLetter keeps commands that failed conversion or submission as
+// JSON files in a directory, so they can be inspected and resubmitted later.
+type deadLetter struct {
+	dir string
+}
+
+type deadLetterEntry struct {
+	ID        string          `json:"id"`
+	Command   string          `json:"command"`
+	Version   int             `json:"version"`
+	Certname  string          `json:"certname,omitempty"`
+	Stage     string          `json:"stage"`
+	Error     string          `json:"error"`
+	Timestamp string          `json:"timestamp"`
+	Retries   int             `json:"retries"`
+	Body      json.RawMessage `json:"body,omitempty"`
+}
+
+type deadLetterEntries []deadLetterEntry
+
+func newDeadLetter(dir string) (*deadLetter, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	return &deadLetter{dir: dir}, nil
+}
+
+// put stores the original v3 command body with the error that made it fail.
+func (d *deadLetter) put(body []byte, v3c v3Commands, stage string, cause error) (string, error) {
+	var e deadLetterEntry
+	e.ID = uuid.New().String()
+	e.Command = v3c.Command
+	e.Version = v3c.Version
+	e.Certname = commandCertname(v3c)
+	e.Stage = stage
+	e.Error = cause.Error()
+	e.Timestamp = time.Now().Format(time.RFC3339)
+	e.Body = body
+
+	return e.ID, d.write(e)
+}
+
+func (d *deadLetter) write(e deadLetterEntry) error {
+	j, err := json.MarshalIndent(&e, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so a crash never leaves a truncated entry.
+	tmp := d.path(e.ID) + ".tmp"
+	if err := ioutil.WriteFile(tmp, j, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path(e.ID))
+}
+
+func (d *deadLetter) path(id string) string {
+	return filepath.Join(d.dir, id+".json")
+}
+
+// get returns a stored entry with its body.
+func (d *deadLetter) get(id string) (deadLetterEntry, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return deadLetterEntry{}, fmt.Errorf("invalid dead letter id %q", id)
+	}
+	b, err := ioutil.ReadFile(d.path(id))
+	if err != nil {
+		return deadLetterEntry{}, err
+	}
+
+	var e deadLetterEntry
+	err = json.Unmarshal(b, &e)
+	if err != nil {
+		return deadLetterEntry{}, err
+	}
+
+	return e, nil
+}
+
+// list returns all stored entries without bodies, oldest first.
+func (d *deadLetter) list() (deadLetterEntries, error) {
+	files, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries = deadLetterEntries{}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		e, err := d.get(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		e.Body = nil
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Timestamp < entries[j].Timestamp
+	})
+
+	return entries, nil
+}
+
+// count returns the number of stored entries, without reading them.
+func (d *deadLetter) count() (int, error) {
+	files, err := os.ReadDir(d.dir)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), ".json") {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (d *deadLetter) remove(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return fmt.Errorf("invalid dead letter id %q", id)
+	}
+	return os.Remove(d.path(id))
+}
+
+// retry converts the stored command again and submits it to PuppetDB.
+// The entry is removed on success and updated with the new error on failure.
+func (d *deadLetter) retry(id string) (response, error) {
+	e, err := d.get(id)
+	if err != nil {
+		return response{}, err
+	}
+
+	var v3c v3Commands
+	err = json.Unmarshal(e.Body, &v3c)
+	if err != nil {
+		return response{}, err
+	}
+
+	data, stage, err := processCommand(v3c)
+	if err != nil {
+		e.Stage = stage
+		e.Error = err.Error()
+		e.Retries++
+		if werr := d.write(e); werr != nil {
+			return response{}, werr
+		}
+		return response{}, err
+	}
+
+	return data, d.remove(id)
+}
+
+// commandCertname returns the node name from a v3 command payload, if any.
+func commandCertname(v3c v3Commands) string {
+	if v3c.Command == httpReportCommand {
+		return httpReportCertname(v3c.Payload)
+	}
+
+	var name string
+	if err := json.Unmarshal(v3c.Payload, &name); err == nil {
+		return name
+	}
+
+	var p struct {
+		Name     string `json:"name"`
+		Certname string `json:"certname"`
+	}
+	if err := json.Unmarshal(v3c.Payload, &p); err != nil {
+		return ""
+	}
+	if p.Certname != "" {
+		return p.Certname
+	}
+
+	return p.Name
+}
+
+// deadLetterCommand is the "deadletter" command line subcommand.
+type deadLetterCommand struct {
+	List   deadLetterListCommand   `command:"list" description:"List dead-lettered commands"`
+	Show   deadLetterShowCommand   `command:"show" description:"Show a dead-lettered command with its body"`
+	Retry  deadLetterRetryCommand  `command:"retry" description:"Convert and resubmit dead-lettered commands (all if no id given)"`
+	Delete deadLetterDeleteCommand `command:"delete" description:"Delete dead-lettered commands"`
+}
+
+type deadLetterListCommand struct{}
+
+type deadLetterShowCommand struct{}
+
+type deadLetterRetryCommand struct{}
+
+type deadLetterDeleteCommand struct{}
+
+var errNoDeadLetterDir = errors.New("dead letter directory is not set (use --deadletter.dir)")
+
+func openDeadLetter() (*deadLetter, error) {
+	if conf().DeadLetterDir == "" {
+		return nil, errNoDeadLetterDir
+	}
+	return newDeadLetter(conf().DeadLetterDir)
+}
+
+func (c *deadLetterListCommand) Execute(args []string) error {
+	d, err := openDeadLetter()
+	if err != nil {
+		return err
+	}
+	entries, err := d.list()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\t%s\n", e.ID, e.Timestamp, e.Certname, e.Command, e.Stage, e.Error)
+	}
+
+	return nil
+}
+
+func (c *deadLetterShowCommand) Execute(args []string) error {
+	d, err := openDeadLetter()
+	if err != nil {
+		return err
+	}
+	for _, id := range args {
+		e, err := d.get(id)
+		if err != nil {
+			return err
+		}
+		j, err := json.MarshalIndent(&e, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(j))
+	}
+
+	return nil
+}
+
+func (c *deadLetterRetryCommand) Execute(args []string) error {
+	d, err := openDeadLetter()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		entries, err := d.list()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			args = append(args, e.ID)
+		}
+	}
+
+	var failed int
+	for _, id := range args {
+		data, err := d.retry(id)
+		if err != nil {
+			fmt.Printf("%s\tfailed\t%v\n", id, err)
+			failed++
+			continue
+		}
+		fmt.Printf("%s\tsubmitted\t%s\n", id, data.UUID)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d commands failed", failed, len(args))
+	}
+
+	return nil
+}
+
+func (c *deadLetterDeleteCommand) Execute(args []string) error {
+	d, err := openDeadLetter()
+	if err != nil {
+		return err
+	}
+	for _, id := range args {
+		if err := d.remove(id); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestDeadLetterRetry(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		status      int
+		wantErr     bool
+		wantStage   string
+		wantRetries int
+	}{
+		{
+			name:   "submitted",
+			body:   `{"command":"deactivate node","version":2,"payload":"web01.example.com"}`,
+			status: http.StatusOK,
+		},
+		{
+			name:        "puppetdb still failing",
+			body:        `{"command":"deactivate node","version":2,"payload":"web01.example.com"}`,
+			status:      http.StatusServiceUnavailable,
+			wantErr:     true,
+			wantStage:   deadLetterStageSubmit,
+			wantRetries: 1,
+		},
+		{
+			name:        "conversion still failing",
+			body:        `{"command":"unknown command","version":1,"payload":"web01.example.com"}`,
+			status:      http.StatusOK,
+			wantErr:     true,
+			wantStage:   deadLetterStageConvert,
+			wantRetries: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"uuid":"5c9e6fa0-2d1b-4a8e-9c6a-0d1e2f3a4b5c"}`))
+			}))
+			defer pdb.Close()
+			setTestConfig(t, &config{PuppetDB: puppetDBConfig{URLs: []string{pdb.URL}}})
+
+			dir, err := ioutil.TempDir("", "deadletter")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			d, err := newDeadLetter(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var v3c v3Commands
+			json.Unmarshal([]byte(tt.body), &v3c)
+			id, err := d.put([]byte(tt.body), v3c, deadLetterStageSubmit, errors.New("PuppetDB returned 503 Service Unavailable"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := d.retry(id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("retry error %v, want error %v", err, tt.wantErr)
+			}
+			e, getErr := d.get(id)
+			if !tt.wantErr {
+				if data.UUID == "" {
+					t.Error("no uuid returned")
+				}
+				if !os.IsNotExist(getErr) {
+					t.Errorf("entry not removed: %v", getErr)
+				}
+				return
+			}
+			if getErr != nil {
+				t.Fatal(getErr)
+			}
+			if e.Stage != tt.wantStage || e.Retries != tt.wantRetries || e.Error != err.Error() {
+				t.Errorf("got stage %q, retries %d, error %q, want %q, %d, %q", e.Stage, e.Retries, e.Error, tt.wantStage, tt.wantRetries, err)
+			}
+			if e.Certname != "web01.example.com" {
+				t.Errorf("got certname %q", e.Certname)
+			}
+		})
+	}
+}
+
+func TestDeadLetterInvalidID(t *testing.T) {
+	d := &deadLetter{dir: os.TempDir()}
+	for _, id := range []string{"../etc/passwd", "", "not-a-uuid"} {
+		if _, err := d.get(id); err == nil {
+			t.Errorf("get %q: no error", id)
+		}
+		if err := d.remove(id); err == nil {
+			t.Errorf("remove %q: no error", id)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of dumped records.
+const (
+	dumpInbound  = "v3"
+	dumpOutbound = "v4"
+	dumpResponse = "response"
+	dumpQuery    = "query"
+)
+
+const dumpTimeLayout = "20060102T150405.000000"
+
+// dumps writes payloads of selected nodes to files for debugging.
+// It is nil outside of the server.
+var dumps *dumper
+
+// dumper writes inbound and outbound payloads, upstream responses and
+// queries of selected nodes as JSON lines into a directory. Files are named
+// $certname-$command-$timestamp.json, rotated by size and only the last
+// retention files are kept for each node and command.
+type dumper struct {
+	mu        sync.Mutex
+	dir       string
+	maxSize   int64
+	retention int
+	targets   []string
+	commands  map[string]bool
+	files     map[string]*dumpFile
+}
+
+type dumpFile struct {
+	name string
+	size int64
+}
+
+type dumpRecord struct {
+	Time     string          `json:"time"`
+	Certname string          `json:"certname"`
+	Command  string          `json:"command"`
+	Kind     string          `json:"kind"`
+	URI      string          `json:"uri,omitempty"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+func newDumper(c dumpConfig) *dumper {
+	d := new(dumper)
+	d.files = make(map[string]*dumpFile)
+	d.set(c)
+
+	return d
+}
+
+// set replaces the dump settings, dropping changes made at runtime.
+func (d *dumper) set(c dumpConfig) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.dir = c.Dir
+	d.maxSize = c.MaxSize
+	d.retention = c.Retention
+	d.targets = append([]string{}, c.Targets...)
+	d.commands = make(map[string]bool)
+	for _, cmd := range c.Commands {
+		d.commands[cmd] = true
+	}
+}
+
+// dumpCommandName returns the short name used to select and name dumps of a command.
+func dumpCommandName(command string) string {
+	switch command {
+	case "replace facts":
+		return "facts"
+	case "replace catalog":
+		return "catalog"
+	case "store report", httpReportCommand:
+		return "report"
+	case "deactivate node":
+		return "deactivate"
+	}
+	return strings.Replace(command, " ", "_", -1)
+}
+
+// match reports whether payloads of the command for certname should be dumped.
+func (d *dumper) match(certname, command string) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.commands[command] {
+		return false
+	}
+	for _, t := range d.targets {
+		if ok, _ := path.Match(t, certname); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// command dumps a payload of a command if the certname and command are selected.
+func (d *dumper) command(certname, command, kind string, payload []byte) {
+	command = dumpCommandName(command)
+	if !d.match(certname, command) {
+		return
+	}
+	d.write(dumpRecord{Certname: certname, Command: command, Kind: kind, Payload: rawJSON(payload)})
+}
+
+// query dumps a query to PuppetDB and its response. Queries are matched by
+// the node name in the URI; queries not scoped to a node are dumped only when
+// "*" is one of the targets.
+func (d *dumper) query(uri string, vs url.Values, body []byte) {
+	var certname string
+	if strings.HasPrefix(uri, "nodes/") {
+		certname = strings.SplitN(strings.TrimPrefix(uri, "nodes/"), "/", 2)[0]
+	}
+	if !d.match(certname, dumpQuery) {
+		return
+	}
+	params, _ := json.Marshal(vs)
+	d.write(dumpRecord{Certname: certname, Command: dumpQuery, Kind: dumpQuery, URI: uri, Payload: params})
+	d.write(dumpRecord{Certname: certname, Command: dumpQuery, Kind: dumpResponse, URI: uri, Payload: rawJSON(body)})
+}
+
+func (d *dumper) write(rec dumpRecord) {
+	rec.Time = time.Now().Format(time.RFC3339Nano)
+	line, err := json.Marshal(&rec)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	prefix := dumpFileName(rec.Certname) + "-" + rec.Command
+	f := d.files[prefix]
+	if f == nil || (d.maxSize > 0 && f.size+int64(len(line)) > d.maxSize) {
+		f = &dumpFile{name: filepath.Join(d.dir, prefix+"-"+time.Now().Format(dumpTimeLayout)+".json")}
+		d.files[prefix] = f
+		d.cleanup(prefix)
+	}
+
+	if err := os.MkdirAll(d.dir, 0750); err != nil {
+		return
+	}
+	file, err := os.OpenFile(f.name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	n, _ := file.Write(line)
+	f.size += int64(n)
+}
+
+// cleanup removes the oldest files with the prefix beyond the retention limit,
+// keeping room for the file being started.
+func (d *dumper) cleanup(prefix string) {
+	if d.retention <= 0 {
+		return
+	}
+	names, err := filepath.Glob(filepath.Join(d.dir, prefix+"-*.json"))
+	if err != nil {
+		return
+	}
+	sort.Strings(names)
+	for len(names) >= d.retention {
+		os.Remove(names[0])
+		names = names[1:]
+	}
+}
+
+// addTarget starts dumping nodes matching the certname glob.
+func (d *dumper) addTarget(pattern string) error {
+	if err := checkPattern(pattern); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, t := range d.targets {
+		if t == pattern {
+			return nil
+		}
+	}
+	d.targets = append(d.targets, pattern)
+
+	return nil
+}
+
+// removeTarget stops dumping nodes matching the certname glob.
+func (d *dumper) removeTarget(pattern string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i, t := range d.targets {
+		if t == pattern {
+			d.targets = append(d.targets[:i], d.targets[i+1:]...)
+			return true
+		}
+	}
+
+	return false
+}
+
+// setCommand enables or disables dumping of a command (facts, catalog, report, deactivate or query).
+func (d *dumper) setCommand(command string, enabled bool) error {
+	switch command {
+	case "facts", "catalog", "report", "deactivate", dumpQuery:
+	default:
+		return fmt.Errorf("unknown dump command %q", command)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if enabled {
+		d.commands[command] = true
+	} else {
+		delete(d.commands, command)
+	}
+
+	return nil
+}
+
+type dumpConfig struct {
+	Dir       string   `yaml:"dir" json:"dir"`
+	MaxSize   int64    `yaml:"max_size" json:"max_size"`
+	Retention int      `yaml:"retention" json:"retention"`
+	Targets   []string `yaml:"targets" json:"targets"`
+	Commands  []string `yaml:"commands" json:"commands"`
+}
+
+// config returns the current dump settings.
+func (d *dumper) config() dumpConfig {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := dumpConfig{Dir: d.dir, MaxSize: d.maxSize, Retention: d.retention}
+	c.Targets = append([]string{}, d.targets...)
+	c.Commands = []string{}
+	for k := range d.commands {
+		c.Commands = append(c.Commands, k)
+	}
+	sort.Strings(c.Commands)
+
+	return c
+}
+
+// checkPattern validates a certname glob.
+func checkPattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid certname pattern %q: %v", pattern, err)
+	}
+	return nil
+}
+
+// dumpFileName makes a certname safe for use in a file name.
+func dumpFileName(certname string) string {
+	if certname == "" {
+		return "_all"
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, certname)
+}
+
+// rawJSON returns b as is if it is valid JSON, or as a JSON string otherwise.
+func rawJSON(b []byte) json.RawMessage {
+	if json.Valid(b) {
+		return b
+	}
+	j, _ := json.Marshal(string(b))
+	return j
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDumperMatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		targets  []string
+		commands []string
+		certname string
+		command  string
+		want     bool
+	}{
+		{
+			name:     "exact certname",
+			targets:  []string{"web01.example.com"},
+			commands: []string{"report"},
+			certname: "web01.example.com",
+			command:  "report",
+			want:     true,
+		},
+		{
+			name:     "glob",
+			targets:  []string{"web*.example.com"},
+			commands: []string{"report"},
+			certname: "web02.example.com",
+			command:  "report",
+			want:     true,
+		},
+		{
+			name:     "other node",
+			targets:  []string{"web*.example.com"},
+			commands: []string{"report"},
+			certname: "db01.example.com",
+			command:  "report",
+		},
+		{
+			name:     "command not selected",
+			targets:  []string{"*"},
+			commands: []string{"facts", "catalog"},
+			certname: "web01.example.com",
+			command:  "report",
+		},
+		{
+			name:     "query not scoped to a node",
+			targets:  []string{"*"},
+			commands: []string{dumpQuery},
+			certname: "",
+			command:  dumpQuery,
+			want:     true,
+		},
+		{
+			name:     "query not scoped to a node without catch-all target",
+			targets:  []string{"web*"},
+			commands: []string{dumpQuery},
+			certname: "",
+			command:  dumpQuery,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDumper(dumpConfig{Targets: tt.targets, Commands: tt.commands})
+			if got := d.match(tt.certname, tt.command); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var d *dumper
+	if d.match("web01.example.com", "report") {
+		t.Error("nil dumper matches")
+	}
+}
+
+func TestDumperCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := newDumper(dumpConfig{Dir: dir, Targets: []string{"web01.example.com"}, Commands: []string{"report"}})
+
+	d.command("web01.example.com", "store report", dumpInbound, []byte(`{"certname":"web01.example.com"}`))
+	d.command("web01.example.com", "store report", dumpResponse, []byte("PuppetDB returned 503"))
+	d.command("web01.example.com", "replace facts", dumpInbound, []byte(`{}`))
+	d.command("db01.example.com", "store report", dumpInbound, []byte(`{}`))
+
+	names, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(names) != 1 {
+		t.Fatalf("got files %v, want one report dump", names)
+	}
+	f, err := os.Open(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var kinds []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec dumpRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid record %s: %v", scanner.Text(), err)
+		}
+		kinds = append(kinds, rec.Kind)
+	}
+	if len(kinds) != 2 || kinds[0] != dumpInbound || kinds[1] != dumpResponse {
+		t.Errorf("got records %v", kinds)
+	}
+}
+
+func TestDumperRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dump")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Every record is larger than the size limit and starts a new file.
+	d := newDumper(dumpConfig{Dir: dir, MaxSize: 10, Retention: 2, Targets: []string{"*"}, Commands: []string{"facts"}})
+	for i := 0; i < 4; i++ {
+		d.command("web01.example.com", "replace facts", dumpInbound, []byte(`{"certname":"web01.example.com"}`))
+		time.Sleep(time.Millisecond)
+	}
+
+	names, _ := filepath.Glob(filepath.Join(dir, "web01.example.com-facts-*.json"))
+	if len(names) != 2 {
+		t.Errorf("got %d files, want 2", len(names))
+	}
+}
@@ -1,6 +1,9 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"strings"
+)
 
 type v3Event struct {
 	Certname          json.RawMessage `json:"certname"`
@@ -50,3 +53,22 @@ func (e *v3Event) MarshalJSON() ([]byte, error) {
 	var a = aliasEvent(*e)
 	return json.Marshal(&a)
 }
+
+// setContainingClass sets the containing class from the containment path
+// when PuppetDB did not send it: the last class of the path, as resources
+// are written as references like File[/etc/motd].
+func (e *v3Event) setContainingClass() {
+	if len(e.ContainingClass) > 0 && string(e.ContainingClass) != "null" {
+		return
+	}
+	var path []string
+	if err := json.Unmarshal(e.ContainmentPath, &path); err != nil {
+		return
+	}
+	for i := len(path) - 1; i >= 0; i-- {
+		if !strings.Contains(path[i], "[") {
+			e.ContainingClass, _ = json.Marshal(path[i])
+			return
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestSetContainingClass(t *testing.T) {
+	tests := []struct {
+		name            string
+		containmentPath string
+		containingClass string
+		want            string
+	}{
+		{"sent by PuppetDB", `["Stage[main]","Motd","File[/etc/motd]"]`, `"Ntp"`, `"Ntp"`},
+		{"last class of the path", `["Stage[main]","Main","Motd","File[/etc/motd]"]`, "", `"Motd"`},
+		{"null", `["Stage[main]","Motd","File[/etc/motd]"]`, "null", `"Motd"`},
+		{"no class", `["Stage[main]","File[/etc/motd]"]`, "", ""},
+		{"no path", "null", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := v3Event{ContainmentPath: []byte(tt.containmentPath)}
+			if tt.containingClass != "" {
+				e.ContainingClass = []byte(tt.containingClass)
+			}
+			e.setContainingClass()
+			if got := string(e.ContainingClass); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
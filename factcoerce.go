@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Types facts are coerced to.
+const (
+	coerceBoolean = "boolean"
+	coerceNumber  = "number"
+	coerceJSON    = "json"
+)
+
+// knownFactTypes are the facts of Facter 1.x and 2.x that Puppet 3 sends as
+// strings, by the type of their value.
+var knownFactTypes = map[string][]string{
+	coerceBoolean: {
+		`^is_virtual$`,
+		`^selinux$`,
+		`^selinux_enforced$`,
+		`^root_home_writable$`,
+	},
+	coerceNumber: {
+		`^(active)?processorcount$`,
+		`^physicalprocessorcount$`,
+		`^uptime_(seconds|hours|days)$`,
+		`^(memory|swap)(size|free)_mb$`,
+		`^blockdevice_[^_]+_size$`,
+		`^mtu_.+$`,
+		`^processor[0-9]+_speed$`,
+	},
+	coerceJSON: {
+		`^os$`,
+		`^partitions$`,
+		`^system_uptime$`,
+		`^processors$`,
+		`^memory$`,
+		`^networking$`,
+		`^disks$`,
+		`^mountpoints$`,
+	},
+}
+
+var factsCoerced = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "puppetdb_proxy_facts_coerced_total",
+		Help: "String facts of replace facts commands coerced to native values, partitioned by type and result: coerced or kept when the string doesn't parse.",
+	},
+	[]string{"type", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(factsCoerced)
+}
+
+// factCoercion lists the facts sent as strings to decode into native values,
+// as regexps of fact names by type. Known adds the facts of Facter 1.x and
+// 2.x. Only the listed facts are decoded, so facts that look like numbers,
+// e.g. serial numbers, stay strings.
+type factCoercion struct {
+	Known    bool     `yaml:"known" json:"known"`
+	Booleans []string `yaml:"booleans" json:"booleans"`
+	Numbers  []string `yaml:"numbers" json:"numbers"`
+	JSON     []string `yaml:"json" json:"json"`
+}
+
+// factCoercer is a validated fact coercion.
+type factCoercer struct {
+	// types holds the fact name regexps by type, in the order they apply.
+	types []coercedType
+}
+
+type coercedType struct {
+	name  string
+	facts []*regexp.Regexp
+}
+
+func (c factCoercion) init() (factCoercer, error) {
+	var fc factCoercer
+	for _, t := range []struct {
+		name     string
+		patterns []string
+	}{
+		{coerceBoolean, c.Booleans},
+		{coerceNumber, c.Numbers},
+		{coerceJSON, c.JSON},
+	} {
+		patterns := t.patterns
+		if c.Known {
+			patterns = append(append([]string{}, patterns...), knownFactTypes[t.name]...)
+		}
+		if len(patterns) == 0 {
+			continue
+		}
+		ct := coercedType{name: t.name}
+		for _, s := range patterns {
+			re, err := regexp.Compile(s)
+			if err != nil {
+				return fc, fmt.Errorf("%s coercion: %v", t.name, err)
+			}
+			ct.facts = append(ct.facts, re)
+		}
+		fc.types = append(fc.types, ct)
+	}
+	return fc, nil
+}
+
+// coerce replaces the string values of the listed facts by the value they
+// encode. Values that are not strings or don't parse are left alone.
+func (fc factCoercer) coerce(facts map[string]json.RawMessage) {
+	if len(fc.types) == 0 {
+		return
+	}
+	for name, v := range facts {
+		var s string
+		if json.Unmarshal(v, &s) != nil {
+			continue
+		}
+		for _, t := range fc.types {
+			if !matchAny(t.facts, name) {
+				continue
+			}
+			if coerced, ok := coerceValue(t.name, s); ok {
+				facts[name] = coerced
+				factsCoerced.WithLabelValues(t.name, "coerced").Inc()
+			} else {
+				factsCoerced.WithLabelValues(t.name, "kept").Inc()
+			}
+			break
+		}
+	}
+}
+
+// coerceValue returns the JSON value of the string, if it is one of the type.
+func coerceValue(t, s string) (json.RawMessage, bool) {
+	switch t {
+	case coerceBoolean:
+		if s == "true" || s == "false" {
+			return json.RawMessage(s), true
+		}
+	case coerceNumber:
+		// JSON numbers only, so values like 0x1f or 007 stay strings.
+		var n json.Number
+		if json.Unmarshal([]byte(s), &n) == nil {
+			return json.RawMessage(n), true
+		}
+	case coerceJSON:
+		b := bytes.TrimSpace([]byte(s))
+		if len(b) > 0 && (b[0] == '{' || b[0] == '[') && json.Valid(b) {
+			return json.RawMessage(b), true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCoerceValue(t *testing.T) {
+	tests := []struct {
+		typ   string
+		value string
+		want  string
+		ok    bool
+	}{
+		{coerceBoolean, "true", "true", true},
+		{coerceBoolean, "false", "false", true},
+		{coerceBoolean, "yes", "", false},
+		{coerceBoolean, "True", "", false},
+		{coerceNumber, "4", "4", true},
+		{coerceNumber, "-1", "-1", true},
+		{coerceNumber, "3951.20", "3951.20", true},
+		{coerceNumber, "1e3", "1e3", true},
+		{coerceNumber, "12345678901234567890", "12345678901234567890", true},
+		{coerceNumber, "0042", "", false},
+		{coerceNumber, "0x1f", "", false},
+		{coerceNumber, "4 cores", "", false},
+		{coerceNumber, "", "", false},
+		{coerceNumber, "NaN", "", false},
+		{coerceJSON, `{"family":"RedHat"}`, `{"family":"RedHat"}`, true},
+		{coerceJSON, ` ["sda","sdb"] `, `["sda","sdb"]`, true},
+		{coerceJSON, `{"family"=>"RedHat"}`, "", false},
+		{coerceJSON, `"quoted"`, "", false},
+		{coerceJSON, `42`, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.typ+" "+tt.value, func(t *testing.T) {
+			got, ok := coerceValue(tt.typ, tt.value)
+			if ok != tt.ok || string(got) != tt.want {
+				t.Errorf("got %s %v, want %s %v", got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestFactCoercerAllowlist(t *testing.T) {
+	c, err := factCoercion{Known: true, Booleans: []string{"^custom_flag$"}}.init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	facts := map[string]json.RawMessage{
+		"is_virtual":     json.RawMessage(`"true"`),
+		"processorcount": json.RawMessage(`"4"`),
+		"memorysize_mb":  json.RawMessage(`"3951.20"`),
+		"os":             json.RawMessage(`"{\"family\":\"RedHat\"}"`),
+		"custom_flag":    json.RawMessage(`"false"`),
+		"serialnumber":   json.RawMessage(`"4242"`),
+		"zipcode":        json.RawMessage(`"1234"`),
+		"uptime_days":    json.RawMessage(`"0x1f"`),
+		"selinux":        json.RawMessage(`false`),
+	}
+	c.coerce(facts)
+	want := map[string]string{
+		"is_virtual":     `true`,
+		"processorcount": `4`,
+		"memorysize_mb":  `3951.20`,
+		"os":             `{"family":"RedHat"}`,
+		"custom_flag":    `false`,
+		"serialnumber":   `"4242"`,
+		"zipcode":        `"1234"`,
+		"uptime_days":    `"0x1f"`,
+		"selinux":        `false`,
+	}
+	got := make(map[string]string)
+	for name, v := range facts {
+		got[name] = string(v)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// TestRedactStringifiedFacts checks that the facts Facter sends as JSON
+// strings are redacted before the fact rules decode them.
+func TestRedactStringifiedFacts(t *testing.T) {
+	c := &config{
+		Redact: []redactionRule{{Name: "iam", Fact: "ec2_metadata.iam.*"}},
+		Facts:  []factRule{{Coerce: factCoercion{JSON: []string{"^ec2_metadata$"}}}},
+	}
+	r, err := c.Redact[0].init(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.redactions = []redaction{r}
+	p, err := c.Facts[0].init(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.factRules = []factPipeline{p}
+	setConfig(c)
+
+	metadata := `{"ami-id":"ami-1","iam":{"security-credentials":{"web":{"SecretAccessKey":"s3cret"}}}}`
+	payload, _ := json.Marshal(map[string]interface{}{
+		"name":        "web01.example.com",
+		"environment": "production",
+		"values":      map[string]string{"ec2_metadata": metadata},
+	})
+	v3c := v3Commands{Command: "replace facts", Version: 3, Payload: payload}
+	if !redactCommand(&v3c, false) {
+		t.Fatal("nothing redacted")
+	}
+	v4c, _, err := convertCommand(v3c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(v4c.Payload), "s3cret") {
+		t.Errorf("secret submitted: %s", v4c.Payload)
+	}
+	var v4f struct {
+		Values struct {
+			EC2Metadata struct {
+				AMIID string            `json:"ami-id"`
+				IAM   map[string]string `json:"iam"`
+			} `json:"ec2_metadata"`
+		} `json:"values"`
+	}
+	if err := json.Unmarshal(v4c.Payload, &v4f); err != nil {
+		t.Fatalf("ec2_metadata not decoded: %v: %s", err, v4c.Payload)
+	}
+	m := v4f.Values.EC2Metadata
+	if m.AMIID != "ami-1" || m.IAM["security-credentials"] != "[REDACTED]" {
+		t.Errorf("got ec2_metadata %+v", m)
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	factsCount = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "puppetdb_proxy_facts_count",
+			Help:    "Number of facts of replace facts commands, partitioned by stage: before or after the fact rules.",
+			Buckets: prometheus.ExponentialBuckets(16, 2, 10),
+		},
+		[]string{"stage"},
+	)
+	factsSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "puppetdb_proxy_facts_size_bytes",
+			Help:    "Size in bytes of the facts of replace facts commands, partitioned by stage: before or after the fact rules.",
+			Buckets: prometheus.ExponentialBuckets(1024, 2, 12),
+		},
+		[]string{"stage"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(factsCount)
+	prometheus.MustRegister(factsSize)
+}
+
+// factRule transforms the facts of the nodes matching the certname glob
+// (all if empty). Include keeps only the facts matching one of its regexps
+// (all if empty), then the facts matching Exclude are dropped, facts are
+// renamed, string facts are coerced and Static facts are set. Every matching
+// rule applies, in order.
+type factRule struct {
+	Certname string                 `yaml:"certname" json:"certname"`
+	Include  []string               `yaml:"include" json:"include"`
+	Exclude  []string               `yaml:"exclude" json:"exclude"`
+	Rename   map[string]string      `yaml:"rename" json:"rename"`
+	Coerce   factCoercion           `yaml:"coerce" json:"coerce"`
+	Static   map[string]interface{} `yaml:"static" json:"static"`
+}
+
+// factPipeline is a validated fact rule.
+type factPipeline struct {
+	factRule
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+	coercer factCoercer
+}
+
+// init validates the rule, i is its index.
+func (r *factRule) init(i int) (factPipeline, error) {
+	p := factPipeline{factRule: *r}
+	if err := checkPattern(r.Certname); err != nil {
+		return p, fmt.Errorf("fact rule %d: %v", i+1, err)
+	}
+	for _, s := range r.Include {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return p, fmt.Errorf("fact rule %d: %v", i+1, err)
+		}
+		p.include = append(p.include, re)
+	}
+	for _, s := range r.Exclude {
+		re, err := regexp.Compile(s)
+		if err != nil {
+			return p, fmt.Errorf("fact rule %d: %v", i+1, err)
+		}
+		p.exclude = append(p.exclude, re)
+	}
+	coercer, err := r.Coerce.init()
+	if err != nil {
+		return p, fmt.Errorf("fact rule %d: %v", i+1, err)
+	}
+	p.coercer = coercer
+	// YAML maps have interface{} keys, which can't be encoded as JSON.
+	for k, v := range r.Static {
+		r.Static[k] = jsonCompatible(v)
+	}
+	return p, nil
+}
+
+func (p factPipeline) matches(certname string) bool {
+	if p.Certname == "" {
+		return true
+	}
+	ok, _ := path.Match(p.Certname, certname)
+	return ok
+}
+
+func (p factPipeline) apply(facts map[string]json.RawMessage) error {
+	for name := range facts {
+		if len(p.include) > 0 && !matchAny(p.include, name) || matchAny(p.exclude, name) {
+			delete(facts, name)
+		}
+	}
+	// Renames are applied in order of the old names, so the result doesn't
+	// depend on the map order when names are swapped.
+	var names []string
+	for name := range p.Rename {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	renamed := make(map[string]json.RawMessage)
+	for _, name := range names {
+		if v, ok := facts[name]; ok {
+			delete(facts, name)
+			renamed[p.Rename[name]] = v
+		}
+	}
+	for name, v := range renamed {
+		facts[name] = v
+	}
+	p.coercer.coerce(facts)
+	for name, v := range p.Static {
+		j, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to encode static fact %s: %v", name, err)
+		}
+		facts[name] = j
+	}
+	return nil
+}
+
+// transformFacts applies the fact rules matching the certname to the facts.
+// The facts are returned as they are when no rule matches.
+func transformFacts(certname string, values json.RawMessage) (json.RawMessage, error) {
+	var facts map[string]json.RawMessage
+	if err := json.Unmarshal(values, &facts); err != nil {
+		return nil, fmt.Errorf("failed to decode facts: %v", err)
+	}
+	factsCount.WithLabelValues("before").Observe(float64(len(facts)))
+	factsSize.WithLabelValues("before").Observe(float64(len(values)))
+
+	var rules []factPipeline
+	for _, p := range conf().factRules {
+		if p.matches(certname) {
+			rules = append(rules, p)
+		}
+	}
+	if len(rules) == 0 {
+		factsCount.WithLabelValues("after").Observe(float64(len(facts)))
+		factsSize.WithLabelValues("after").Observe(float64(len(values)))
+		return values, nil
+	}
+
+	for _, p := range rules {
+		if err := p.apply(facts); err != nil {
+			return nil, err
+		}
+	}
+
+	j, err := json.Marshal(facts)
+	if err != nil {
+		return nil, err
+	}
+	factsCount.WithLabelValues("after").Observe(float64(len(facts)))
+	factsSize.WithLabelValues("after").Observe(float64(len(j)))
+	traces.tracef(certname, "applied %d fact rules", len(rules))
+
+	return j, nil
+}
+
+func matchAny(res []*regexp.Regexp, s string) bool {
+	for _, re := range res {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestFactPipelineApply(t *testing.T) {
+	facts := `{"os":"CentOS","path":"/bin","macaddress_eth0":"aa","role_legacy":"web","role":"old","serialnumber":"0042"}`
+	tests := []struct {
+		name string
+		rule factRule
+		want string
+	}{
+		{
+			name: "no rule",
+			want: facts,
+		},
+		{
+			name: "include",
+			rule: factRule{Include: []string{"^os$", "^role"}},
+			want: `{"os":"CentOS","role_legacy":"web","role":"old"}`,
+		},
+		{
+			name: "exclude after include",
+			rule: factRule{Include: []string{"^os$", "^role"}, Exclude: []string{"^role$"}},
+			want: `{"os":"CentOS","role_legacy":"web"}`,
+		},
+		{
+			name: "rename after exclude",
+			rule: factRule{Exclude: []string{"^role_legacy$"}, Rename: map[string]string{"role_legacy": "role"}},
+			want: `{"os":"CentOS","path":"/bin","macaddress_eth0":"aa","role":"old","serialnumber":"0042"}`,
+		},
+		{
+			name: "rename replaces the fact",
+			rule: factRule{Rename: map[string]string{"role_legacy": "role"}},
+			want: `{"os":"CentOS","path":"/bin","macaddress_eth0":"aa","role":"web","serialnumber":"0042"}`,
+		},
+		{
+			name: "swapped names",
+			rule: factRule{Include: []string{"^os$", "^path$"}, Rename: map[string]string{"os": "path", "path": "os"}},
+			want: `{"os":"/bin","path":"CentOS"}`,
+		},
+		{
+			name: "static facts last",
+			rule: factRule{Include: []string{"^os$"}, Rename: map[string]string{"os": "platform"}, Static: map[string]interface{}{"platform": "linux", "dc": map[interface{}]interface{}{"name": "ams1"}}},
+			want: `{"platform":"linux","dc":{"name":"ams1"}}`,
+		},
+		{
+			name: "static facts are not coerced",
+			rule: factRule{Include: []string{"^os$"}, Static: map[string]interface{}{"major": "7"}, Coerce: factCoercion{Numbers: []string{"^major$"}}},
+			want: `{"os":"CentOS","major":"7"}`,
+		},
+		{
+			name: "numeric looking serial stays a string",
+			rule: factRule{Include: []string{"^serialnumber$"}, Coerce: factCoercion{Known: true, Numbers: []string{"^serialnumber$"}}},
+			want: `{"serialnumber":"0042"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := tt.rule.init(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var values map[string]json.RawMessage
+			json.Unmarshal([]byte(facts), &values)
+			if err := p.apply(values); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := json.Marshal(values)
+			var gotValues, wantValues interface{}
+			json.Unmarshal(got, &gotValues)
+			json.Unmarshal([]byte(tt.want), &wantValues)
+			if !reflect.DeepEqual(gotValues, wantValues) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFactPipelineMatches(t *testing.T) {
+	p, _ := (&factRule{Certname: "*.ams1.example.com"}).init(0)
+	if !p.matches("web01.ams1.example.com") || p.matches("web01.fra1.example.com") {
+		t.Error("certname glob mismatch")
+	}
+	all, _ := (&factRule{}).init(0)
+	if !all.matches("web01.fra1.example.com") {
+		t.Error("rule without certname doesn't match all nodes")
+	}
+}
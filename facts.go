@@ -28,8 +28,7 @@ type v4Facts struct {
 func v3toV4FactsConv(v3f v3Facts) v4Facts {
 	var v4f v4Facts
 	v4f.Certname = v3f.Certname
-	v4f.Environment = opts.Environment
-	v4f.Producer = opts.Producer
+	v4f.Environment, v4f.Producer = conf().rewrite(v3f.Certname)
 	v4f.ProducerTimestamp = time.Now().Format(time.RFC3339)
 	v4f.Values = v3f.Values
 
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// foremanConfigReport is the body of POST /api/config_reports, as sent by
+// the puppet-foreman report processor.
+type foremanConfigReport struct {
+	ConfigReport foremanReport `json:"config_report"`
+}
+
+type foremanReport struct {
+	Host       string                        `json:"host"`
+	ReportedAt string                        `json:"reported_at"`
+	Status     map[string]int                `json:"status"`
+	Metrics    map[string]map[string]float64 `json:"metrics"`
+	Logs       []foremanLogEntry             `json:"logs"`
+}
+
+type foremanLogEntry struct {
+	Log foremanLog `json:"log"`
+}
+
+type foremanLog struct {
+	Sources  foremanLogSource  `json:"sources"`
+	Messages foremanLogMessage `json:"messages"`
+	Level    string            `json:"level"`
+}
+
+type foremanLogSource struct {
+	Source string `json:"source"`
+}
+
+type foremanLogMessage struct {
+	Message string `json:"message"`
+}
+
+// foremanSink posts every report to Foreman as a config report.
+type foremanSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newForemanSink(c sinkConfig) (*foremanSink, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &foremanSink{
+		url:     strings.TrimSuffix(c.URL, "/") + "/api/config_reports",
+		headers: c.Headers,
+		client:  &http.Client{Timeout: c.Timeout, Transport: transport},
+	}, nil
+}
+
+func (s *foremanSink) write(e sinkEntry) error {
+	if e.Report == nil {
+		return nil
+	}
+	j, err := json.Marshal(foremanConfigReport{ConfigReport: newForemanReport(e.Report)})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(j))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json,version=2")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post report of %s: %v", e.Certname, err)
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to post report of %s: Foreman returned %s: %s", e.Certname, resp.Status, b)
+	}
+	return nil
+}
+
+func (s *foremanSink) flush() error {
+	return nil
+}
+
+func (s *foremanSink) close() error {
+	return nil
+}
+
+// newForemanReport builds the config report from the events of the report.
+// Puppet 3 agents send no restarts, so restarted and failed_restarts are 0.
+func newForemanReport(r *v4Report) foremanReport {
+	var fr foremanReport
+	fr.Host = r.Certname
+	fr.ReportedAt = r.EndTime
+
+	events, resources := reportCounts(r)
+	for _, res := range r.Resources {
+		for _, ev := range res.Events {
+			fr.Logs = append(fr.Logs, foremanLogEntry{Log: foremanLog{
+				Sources:  foremanLogSource{Source: eventSource(res.ResourceType, res.ResourceTitle, res.ContainmentPath, ev.Property)},
+				Messages: foremanLogMessage{Message: ev.Message},
+				Level:    foremanLogLevel(ev.Status),
+			}})
+		}
+	}
+
+	fr.Metrics = map[string]map[string]float64{
+		"resources": resources,
+		"events":    events,
+		"changes":   {"total": events["success"]},
+		"time":      {"total": runDuration(r)},
+	}
+	fr.Status = map[string]int{
+		"applied":         int(events["success"]),
+		"restarted":       0,
+		"failed":          int(resources["failed"]),
+		"failed_restarts": 0,
+		"skipped":         int(resources["skipped"]),
+		"pending":         int(events["noop"]),
+	}
+	if fr.Logs == nil {
+		fr.Logs = []foremanLogEntry{}
+	}
+
+	return fr
+}
+
+func foremanLogLevel(status string) string {
+	if status == "failure" {
+		return "err"
+	}
+	return "notice"
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestNewForemanReport(t *testing.T) {
+	tests := []struct {
+		name       string
+		resources  v4Resources
+		wantStatus map[string]int
+		wantLogs   []string
+	}{
+		{
+			name:       "no resources",
+			wantStatus: map[string]int{"applied": 0, "restarted": 0, "failed": 0, "failed_restarts": 0, "skipped": 0, "pending": 0},
+		},
+		{
+			name: "changed and failed",
+			resources: v4Resources{
+				{
+					ResourceType:    "File",
+					ResourceTitle:   "/etc/motd",
+					ContainmentPath: []string{"Stage[main]", "Motd", "File[/etc/motd]"},
+					Events:          []v4ResourceEventExpanded{{Status: "success", Property: "content"}, {Status: "success", Property: "mode"}},
+				},
+				{
+					ResourceType:  "Service",
+					ResourceTitle: "ntpd",
+					Events:        []v4ResourceEventExpanded{{Status: "failure", Property: "ensure"}},
+				},
+			},
+			wantStatus: map[string]int{"applied": 2, "restarted": 0, "failed": 1, "failed_restarts": 0, "skipped": 0, "pending": 0},
+			wantLogs:   []string{"/Stage[main]/Motd/File[/etc/motd]/content", "/Stage[main]/Motd/File[/etc/motd]/mode", "/Service[ntpd]/ensure"},
+		},
+		{
+			name: "noop and skipped",
+			resources: v4Resources{
+				{ResourceType: "Package", ResourceTitle: "ntp", Events: []v4ResourceEventExpanded{{Status: "noop"}}},
+				{ResourceType: "Exec", ResourceTitle: "reload", Skipped: true},
+			},
+			wantStatus: map[string]int{"applied": 0, "restarted": 0, "failed": 0, "failed_restarts": 0, "skipped": 1, "pending": 1},
+			wantLogs:   []string{"/Package[ntp]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fr := newForemanReport(&v4Report{
+				Certname:  "web01.example.com",
+				StartTime: "2019-01-02T03:04:00.000Z",
+				EndTime:   "2019-01-02T03:04:05.000Z",
+				Resources: tt.resources,
+			})
+			if !reflect.DeepEqual(fr.Status, tt.wantStatus) {
+				t.Errorf("got status %v, want %v", fr.Status, tt.wantStatus)
+			}
+			var logs []string
+			for _, l := range fr.Logs {
+				logs = append(logs, l.Log.Sources.Source)
+			}
+			if !reflect.DeepEqual(logs, tt.wantLogs) {
+				t.Errorf("got logs %v, want %v", logs, tt.wantLogs)
+			}
+			if fr.Metrics["time"]["total"] != 5 {
+				t.Errorf("got run time %v, want 5", fr.Metrics["time"]["total"])
+			}
+		})
+	}
+}
+
+func TestForemanSink(t *testing.T) {
+	var got foremanConfigReport
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/config_reports" {
+			t.Errorf("got path %s", r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	c := sinkConfig{Type: sinkForeman, URL: srv.URL + "/"}
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newForemanSink(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.write(sinkEntry{Certname: "web01.example.com", Command: "replace facts"}); err != nil {
+		t.Fatal(err)
+	}
+	if got.ConfigReport.Host != "" {
+		t.Error("posted a command other than a report")
+	}
+	if err := s.write(sinkEntry{Certname: "web01.example.com", Command: "store report", Report: &v4Report{Certname: "web01.example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got.ConfigReport.Host != "web01.example.com" {
+		t.Errorf("got report %+v", got.ConfigReport)
+	}
+}
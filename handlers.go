@@ -8,7 +8,6 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -46,8 +45,19 @@ func (s *server) initRoutes() {
 	// Commands
 	v3.HandleFunc("/commands", s.v3commandsHandler).Methods(http.MethodPost)
 
+	// Reports of the Puppet http report processor
+	s.Router.HandleFunc("/reports", s.httpReportsHandler).Methods(http.MethodPost)
+
 	// Prometheus
 	s.Router.Handle("/metrics", promhttp.Handler())
+
+	// Health checks
+	s.Router.HandleFunc("/healthz", s.healthzHandler).Methods(http.MethodGet)
+	s.Router.HandleFunc("/readyz", s.readyzHandler).Methods(http.MethodGet)
+
+	// Event streams
+	s.Router.HandleFunc("/stream/reports", s.streamReportsHandler).Methods(http.MethodGet).Name(streamRoute)
+	s.Router.HandleFunc("/stream/commands", s.streamCommandsHandler).Methods(http.MethodGet).Name(streamRoute)
 }
 
 func (s *server) v3nodesHandler(w http.ResponseWriter, r *http.Request) {
@@ -326,7 +336,7 @@ func (s *server) v3factByNameAndValue(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) v3factNamesHandler(w http.ResponseWriter, r *http.Request) {
-	resp, err := http.Get(opts.PuppetDBURL + "/pdb/query/v4/fact-names")
+	resp, err := getRaw("/pdb/query/v4/fact-names")
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
@@ -544,7 +554,7 @@ func (s *server) v3aggregateEventCountsHandler(w http.ResponseWriter, r *http.Re
 }
 
 func (s *server) v3serverTimeHandler(w http.ResponseWriter, r *http.Request) {
-	resp, err := http.Get(opts.PuppetDBURL + "/pdb/meta/v1/server-time")
+	resp, err := getRaw("/pdb/meta/v1/server-time")
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
@@ -559,7 +569,7 @@ func (s *server) v3serverTimeHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) v3versionHandler(w http.ResponseWriter, r *http.Request) {
-	resp, err := http.Get(opts.PuppetDBURL + "/pdb/meta/v1/version")
+	resp, err := getRaw("/pdb/meta/v1/version")
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
@@ -574,12 +584,16 @@ func (s *server) v3versionHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) v3commandsHandler(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
-	var v3c v3Commands
-	var v4c v4Commands
-	var values url.Values
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		s.Log.Errorf("failed to read request body: %v", err)
+		return
+	}
 
-	err := decoder.Decode(&v3c)
+	var v3c v3Commands
+	err = json.Unmarshal(body, &v3c)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
@@ -587,99 +601,254 @@ func (s *server) v3commandsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	data, stage, err := processCommand(v3c)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		s.Log.Errorf("failed to %s %s command: %v", stage, v3c.Command, err)
+		s.storeDeadLetter(body, v3c, stage, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// storeDeadLetter keeps a failed command in the dead letter directory, if enabled.
+func (s *server) storeDeadLetter(body []byte, v3c v3Commands, stage string, cause error) {
+	if s.DeadLetter == nil {
+		return
+	}
+	// Keep no secrets on disk, the command is redacted again when retried.
+	if redactCommand(&v3c, false) {
+		body, _ = json.Marshal(&v3c)
+	}
+	id, err := s.DeadLetter.put(body, v3c, stage, cause)
+	if err != nil {
+		s.Log.Errorf("failed to store %s command in dead letter directory: %v", v3c.Command, err)
+		return
+	}
+	s.Log.Warnf("%s command for %s stored in dead letter directory with id %s", v3c.Command, commandCertname(v3c), id)
+}
+
+// processCommand converts a v3 command and submits it to PuppetDB.
+// On error it also returns the stage that failed.
+func processCommand(v3c v3Commands) (response, string, error) {
+	redactCommand(&v3c, true)
+	certname := commandCertname(v3c)
+	version := strconv.Itoa(v3c.Version)
+	dumps.command(certname, v3c.Command, dumpInbound, v3c.Payload)
+	traces.tracef(certname, "received %s command version %d: %s", v3c.Command, v3c.Version, v3c.Payload)
+	payloadSize.WithLabelValues(commandLabel(v3c.Command), "v3").Observe(float64(len(v3c.Payload)))
+
+	start := time.Now()
+	v4c, values, err := convertCommand(v3c)
+	if err != nil {
+		commandsTotal.WithLabelValues(commandLabel(v3c.Command), version, "convert_error").Inc()
+		traces.tracef(certname, "failed to convert %s command: %v", v3c.Command, err)
+		return response{}, deadLetterStageConvert, err
+	}
+	conversionDuration.WithLabelValues(v4c.Command).Observe(time.Since(start).Seconds())
+	payloadSize.WithLabelValues(commandLabel(v4c.Command), "v4").Observe(float64(len(v4c.Payload)))
+	dumps.command(certname, v4c.Command, dumpOutbound, v4c.Payload)
+	traces.tracef(certname, "converted %s command to version %d: %s", v4c.Command, v4c.Version, v4c.Payload)
+	if v4c.Command == "deactivate node" {
+		nodeRuns.forget(certname)
+		alerts.forget(certname)
+		catalogHistory.forget(certname)
+		catalogIDs.forget(certname)
+		lastCatalogs.forget(certname)
+		catalogSizes.forget(certname)
+	}
+
+	data, err := submitCommand(v4c, values)
+	if err != nil {
+		commandsTotal.WithLabelValues(commandLabel(v3c.Command), version, "submit_error").Inc()
+		dumps.command(certname, v4c.Command, dumpResponse, []byte(err.Error()))
+		traces.tracef(certname, "failed to submit %s command: %v", v4c.Command, err)
+		streams.publish(certname, v4c, "submit_error")
+		return response{}, deadLetterStageSubmit, err
+	}
+	commandsTotal.WithLabelValues(commandLabel(v3c.Command), version, "ok").Inc()
+	markSubmission()
+	// Commands are written to the sinks and runs are observed once PuppetDB
+	// accepted them, a dead-lettered command when its retry succeeds.
+	sinks.write(certname, v4c)
+	nodeRuns.observe(v4c.Report)
+	alerts.observe(v4c.Report)
+	resp, _ := json.Marshal(&data)
+	dumps.command(certname, v4c.Command, dumpResponse, resp)
+	traces.tracef(certname, "submitted %s command with uuid %s", v4c.Command, data.UUID)
+	streams.publish(certname, v4c, "ok")
+
+	return data, "", nil
+}
+
+func convertCommand(v3c v3Commands) (v4Commands, url.Values, error) {
+	var v4c v4Commands
+	var values url.Values
+	var err error
+
 	v4c.Command = v3c.Command
 	switch v4c.Command {
 	case "replace facts":
 		v4c.Version = 5
 		v4c.Payload, values, err = getV4FactsPayload(v3c.Payload)
-		if err != nil {
-			body, _ := ioutil.ReadAll(r.Body)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			s.Log.Errorf("failed parse to payload for replace facts command: %v", err)
-			s.Log.Trace(string(body))
-			return
-		}
 	case "replace catalog":
 		v4c.Version = 9
 		v4c.Payload, values, err = getV4CatalogPayload(v3c.Payload)
-		if err != nil {
-			body, _ := ioutil.ReadAll(r.Body)
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			s.Log.Errorf("failed parse to payload for replace catalog command: %v", err)
-			s.Log.Trace(string(body))
-			return
-		}
 	case "store report":
 		v4c.Version = 8
-		v4c.Payload, values, err = getV4ReportPayload(v3c.Payload)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			s.Log.Errorf("failed parse to payload for store report command: %v", err)
-			s.Log.Trace(string(v3c.Payload))
-			return
-		}
+		v4c.Payload, values, v4c.Report, err = getV4ReportPayload(v3c.Payload)
+	case httpReportCommand:
+		v4c.Command = "store report"
+		v4c.Version = 8
+		v4c.Payload, values, v4c.Report, err = getV4HTTPReportPayload(v3c.Payload)
 	case "deactivate node":
 		v4c.Version = 3
 		v4c.Payload, values, err = getV4DeactivatePayload(v3c.Payload)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			w.Write([]byte(err.Error()))
-			s.Log.Errorf("failed to parse payload for deactivate node command: %v", err)
-			return
-		}
 	default:
-		s.Log.Error("unable to unmarshal JSON data")
+		err = fmt.Errorf("unknown command %q", v3c.Command)
+	}
+	if err != nil {
+		return v4Commands{}, nil, err
 	}
 
 	// Add URL parameters
 	values.Set("command", strings.Replace(v4c.Command, " ", "_", -1))
 	values.Set("version", strconv.Itoa(v4c.Version))
 
+	return v4c, values, nil
+}
+
+func submitCommand(v4c v4Commands, values url.Values) (response, error) {
 	body, err := json.Marshal(v4c.Payload)
+	if err != nil {
+		return response{}, fmt.Errorf("failed to marshal v4c: %v", err)
+	}
+	resp, err := postWithData(body, values)
+	if err != nil {
+		return response{}, err
+	}
+	var data response
+	err = json.Unmarshal(resp, &data)
+	if err != nil {
+		return response{}, fmt.Errorf("failed to unmarshal response %q: %v", resp, err)
+	}
+
+	return data, nil
+}
+
+func (s *server) deadLetterListHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.DeadLetter.list()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte(err.Error()))
-		s.Log.Errorf("failed to marshal v4c: %v", err)
+		s.Log.Errorf("failed to list dead letter directory: %v", err)
 		return
 	}
-	resp, err := postWithData(body, values)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(entries)
+}
+
+func (s *server) deadLetterGetHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	e, err := s.DeadLetter.get(id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusNotFound)
 		w.Write([]byte(err.Error()))
-		s.Log.Errorf("failed to do POST request with data: %v", err)
 		return
 	}
-	var data response
-	err = json.Unmarshal(resp, &data)
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(e)
+}
+
+func (s *server) deadLetterDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	err := s.DeadLetter.remove(id)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	s.Log.Infof("dead letter %s deleted", id)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) deadLetterRetryHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id := vars["id"]
+
+	data, err := s.DeadLetter.retry(id)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
 		w.Write([]byte(err.Error()))
-		s.Log.Errorf("failed to unmarshal response: %v", err)
-		s.Log.Trace(string(resp))
+		s.Log.Errorf("failed to retry dead letter %s: %v", id, err)
 		return
 	}
+	s.Log.Infof("dead letter %s resubmitted with uuid %s", id, data.UUID)
 
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(data)
 }
 
+// deadLetterRetryAllHandler resubmits every stored command and reports
+// the result for each of them.
+func (s *server) deadLetterRetryAllHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.DeadLetter.list()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		s.Log.Errorf("failed to list dead letter directory: %v", err)
+		return
+	}
+
+	type result struct {
+		ID    string `json:"id"`
+		UUID  string `json:"uuid,omitempty"`
+		Error string `json:"error,omitempty"`
+	}
+	var results = []result{}
+	for _, e := range entries {
+		res := result{ID: e.ID}
+		data, err := s.DeadLetter.retry(e.ID)
+		if err != nil {
+			res.Error = err.Error()
+			s.Log.Errorf("failed to retry dead letter %s: %v", e.ID, err)
+		} else {
+			res.UUID = data.UUID
+			s.Log.Infof("dead letter %s resubmitted with uuid %s", e.ID, data.UUID)
+		}
+		results = append(results, res)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(results)
+}
+
 func getV4FactsPayload(v3payload json.RawMessage) (json.RawMessage, url.Values, error) {
 	var v3f v3Facts
 	if err := json.Unmarshal(v3payload, &v3f); err != nil {
 		return nil, nil, err
 	}
-	if opts.DumpFacts && opts.DumpHostname != "" {
-		if v3f.Certname == opts.DumpHostname {
-			file, _ := os.OpenFile("/tmp/"+opts.DumpHostname+"-reports.json", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-			defer file.Close()
-			fmt.Fprintln(file, string(v3payload))
-		}
-	}
 	var v4f = v3toV4FactsConv(v3f)
+	values, err := transformFacts(v4f.Certname, v4f.Values)
+	if err != nil {
+		return nil, nil, err
+	}
+	v4f.Values = values
 
 	v := url.Values{}
 	v.Set("certname", v4f.Certname)
@@ -689,26 +858,20 @@ func getV4FactsPayload(v3payload json.RawMessage) (json.RawMessage, url.Values,
 	return j, v, err
 }
 
-func getV4ReportPayload(v3payload json.RawMessage) (json.RawMessage, url.Values, error) {
+func getV4ReportPayload(v3payload json.RawMessage) (json.RawMessage, url.Values, *v4Report, error) {
 	var v3r v3Report
 	if err := json.Unmarshal(v3payload, &v3r); err != nil {
-		return nil, nil, err
-	}
-	if opts.DumpReport && opts.DumpHostname != "" {
-		if v3r.Certname == opts.DumpHostname {
-			file, _ := os.OpenFile("/tmp/"+opts.DumpHostname+"-reports.json", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-			defer file.Close()
-			fmt.Fprintln(file, string(v3payload))
-		}
+		return nil, nil, nil, err
 	}
 	var report = v3toV4ReportConv(v3r)
+	catalogHistory.mark(&report)
 
 	v := url.Values{}
 	v.Set("certname", report.Certname)
 	v.Set("producer-timestamp", report.ProducerTimestamp)
 
 	j, err := json.Marshal(&report)
-	return j, v, err
+	return j, v, &report, err
 }
 
 func getV4CatalogPayload(v3payload json.RawMessage) (json.RawMessage, url.Values, error) {
@@ -716,14 +879,13 @@ func getV4CatalogPayload(v3payload json.RawMessage) (json.RawMessage, url.Values
 	if err := json.Unmarshal(v3payload, &v3c); err != nil {
 		return nil, nil, err
 	}
-	if opts.DumpCatalog && opts.DumpHostname != "" {
-		if v3c.Name == opts.DumpHostname {
-			file, _ := os.OpenFile("/tmp/"+opts.DumpHostname+"-reports.json", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-			defer file.Close()
-			fmt.Fprintln(file, string(v3payload))
-		}
-	}
 	var catalog = v3toV4CatalogConv(v3c)
+	if err := catalogCheck.validate(&catalog); err != nil {
+		return nil, nil, err
+	}
+	catalogSizes.strip(&catalog)
+	catalogHistory.observe(&catalog)
+	lastCatalogs.observe(&catalog)
 
 	v := url.Values{}
 	v.Set("certname", catalog.Certname)
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Check statuses.
+const (
+	healthOK       = "ok"
+	healthFail     = "fail"
+	healthDisabled = "disabled"
+)
+
+// healthChecker runs the readiness checks. The PuppetDB probe is cached for
+// the configured TTL, so frequent probes don't load PuppetDB. The mutex
+// guards the cached probe and the last errors, checks run without it.
+type healthChecker struct {
+	mu       sync.Mutex
+	puppetDB healthCheck
+	lastErr  map[string]string
+}
+
+type healthCheck struct {
+	Status    string  `json:"status"`
+	Latency   float64 `json:"latency_seconds"`
+	CheckedAt string  `json:"checked_at"`
+	Error     string  `json:"error,omitempty"`
+	LastError string  `json:"last_error,omitempty"`
+
+	checked time.Time
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+func newHealthChecker() *healthChecker {
+	h := new(healthChecker)
+	h.lastErr = make(map[string]string)
+	return h
+}
+
+func (s *server) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(healthReport{Status: healthOK})
+}
+
+func (s *server) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	report := s.Health.check(s.DeadLetter)
+	status := http.StatusOK
+	if report.Status != healthOK {
+		status = http.StatusServiceUnavailable
+		s.Log.Debugf("not ready: %+v", report.Checks)
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// check runs all readiness checks.
+func (h *healthChecker) check(d *deadLetter) healthReport {
+	c := conf()
+	report := healthReport{Status: healthOK, Checks: make(map[string]healthCheck)}
+
+	h.mu.Lock()
+	puppetDB := h.puppetDB
+	h.mu.Unlock()
+	if time.Since(puppetDB.checked) > c.Health.CacheTTL {
+		puppetDB = h.run("puppetdb", func() error { return probePuppetDB(c.Health.Timeout) })
+		h.mu.Lock()
+		h.puppetDB = puppetDB
+		h.mu.Unlock()
+	}
+	report.Checks["puppetdb"] = puppetDB
+
+	if d == nil {
+		report.Checks["spool"] = healthCheck{Status: healthDisabled}
+	} else {
+		report.Checks["spool"] = h.run("spool", func() error { return checkSpool(d, c.Health.SpoolMaxEntries) })
+	}
+
+	var dirs []string
+	if c.DeadLetterDir != "" {
+		dirs = append(dirs, c.DeadLetterDir)
+	}
+	if _, err := os.Stat(c.Dump.Dir); err == nil {
+		dirs = append(dirs, c.Dump.Dir)
+	}
+	if len(dirs) == 0 {
+		report.Checks["disk"] = healthCheck{Status: healthDisabled}
+	} else {
+		report.Checks["disk"] = h.run("disk", func() error { return checkDiskSpace(dirs, c.Health.MinFreeBytes) })
+	}
+
+	for _, check := range report.Checks {
+		if check.Status == healthFail {
+			report.Status = healthFail
+		}
+	}
+
+	return report
+}
+
+// run times a check and keeps its last error.
+func (h *healthChecker) run(name string, fn func() error) healthCheck {
+	start := time.Now()
+	err := fn()
+
+	var c healthCheck
+	c.checked = time.Now()
+	c.Latency = c.checked.Sub(start).Seconds()
+	c.CheckedAt = c.checked.Format(time.RFC3339)
+	c.Status = healthOK
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err != nil {
+		c.Status = healthFail
+		c.Error = err.Error()
+		h.lastErr[name] = c.checked.Format(time.RFC3339) + ": " + err.Error()
+	}
+	c.LastError = h.lastErr[name]
+
+	return c
+}
+
+// probePuppetDB checks that PuppetDB answers its version endpoint.
+func probePuppetDB(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := doWithBackends("meta/v1/version", func(base string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, base+"/pdb/meta/v1/version", nil)
+		if err != nil {
+			return nil, err
+		}
+		return req.WithContext(ctx), nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("PuppetDB returned %s", resp.Status)
+	}
+	var v struct {
+		Version string `json:"version"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&v); err != nil {
+		return fmt.Errorf("failed to decode PuppetDB version: %v", err)
+	}
+
+	return nil
+}
+
+// checkSpool checks that the dead letter directory is writable and not
+// holding more than maxEntries commands.
+func checkSpool(d *deadLetter, maxEntries int) error {
+	f, err := ioutil.TempFile(d.dir, ".health-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	if maxEntries <= 0 {
+		return nil
+	}
+	n, err := d.count()
+	if err != nil {
+		return err
+	}
+	if n > maxEntries {
+		return fmt.Errorf("%d commands in dead letter directory, more than %d", n, maxEntries)
+	}
+
+	return nil
+}
+
+// checkDiskSpace checks that every directory has at least minFree bytes available.
+func checkDiskSpace(dirs []string, minFree uint64) error {
+	for _, dir := range dirs {
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(dir, &st); err != nil {
+			return err
+		}
+		free := st.Bavail * uint64(st.Bsize)
+		if free < minFree {
+			return fmt.Errorf("%s has %d bytes free, less than %d", dir, free, minFree)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestHealthCheck(t *testing.T) {
+	tests := []struct {
+		name            string
+		puppetDBStatus  int
+		spool           bool
+		spoolEntries    int
+		spoolMaxEntries int
+		wantStatus      string
+		wantChecks      map[string]string
+	}{
+		{
+			name:           "ready without spool",
+			puppetDBStatus: http.StatusOK,
+			wantStatus:     healthOK,
+			wantChecks:     map[string]string{"puppetdb": healthOK, "spool": healthDisabled},
+		},
+		{
+			name:           "PuppetDB down",
+			puppetDBStatus: http.StatusServiceUnavailable,
+			wantStatus:     healthFail,
+			wantChecks:     map[string]string{"puppetdb": healthFail, "spool": healthDisabled},
+		},
+		{
+			name:            "spool below limit",
+			puppetDBStatus:  http.StatusOK,
+			spool:           true,
+			spoolEntries:    2,
+			spoolMaxEntries: 2,
+			wantStatus:      healthOK,
+			wantChecks:      map[string]string{"puppetdb": healthOK, "spool": healthOK, "disk": healthOK},
+		},
+		{
+			name:            "spool over limit",
+			puppetDBStatus:  http.StatusOK,
+			spool:           true,
+			spoolEntries:    3,
+			spoolMaxEntries: 2,
+			wantStatus:      healthFail,
+			wantChecks:      map[string]string{"puppetdb": healthOK, "spool": healthFail, "disk": healthOK},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.puppetDBStatus)
+				w.Write([]byte(`{"version":"6.0.0"}`))
+			}))
+			defer pdb.Close()
+
+			c := &config{PuppetDB: puppetDBConfig{URLs: []string{pdb.URL}}}
+			c.Health.Timeout = time.Second
+			c.Health.SpoolMaxEntries = tt.spoolMaxEntries
+			var d *deadLetter
+			if tt.spool {
+				dir, err := ioutil.TempDir("", "deadletter")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer os.RemoveAll(dir)
+				d, _ = newDeadLetter(dir)
+				for i := 0; i < tt.spoolEntries; i++ {
+					d.put([]byte(`{}`), v3Commands{Command: "store report"}, deadLetterStageSubmit, errors.New("PuppetDB returned 503"))
+				}
+				c.DeadLetterDir = dir
+			}
+			setTestConfig(t, c)
+
+			report := newHealthChecker().check(d)
+			if report.Status != tt.wantStatus {
+				t.Errorf("got status %s, want %s", report.Status, tt.wantStatus)
+			}
+			for name, want := range tt.wantChecks {
+				if got := report.Checks[name].Status; got != want {
+					t.Errorf("got %s check %s, want %s (%s)", name, got, want, report.Checks[name].Error)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthCheckCache(t *testing.T) {
+	var probes int
+	pdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		w.Write([]byte(`{"version":"6.0.0"}`))
+	}))
+	defer pdb.Close()
+	c := &config{PuppetDB: puppetDBConfig{URLs: []string{pdb.URL}}}
+	c.Health.Timeout = time.Second
+	c.Health.CacheTTL = time.Minute
+	setTestConfig(t, c)
+
+	h := newHealthChecker()
+	h.check(nil)
+	h.check(nil)
+	if probes != 1 {
+		t.Errorf("got %d PuppetDB probes within the cache TTL, want 1", probes)
+	}
+}
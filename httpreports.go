@@ -0,0 +1,359 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// httpReportCommand is the command of reports posted by the Puppet http
+// report processor. Its payload is the YAML report as a JSON string, so it
+// goes through dumps and the dead letter directory like other commands.
+const httpReportCommand = "store http report"
+
+// httpReport is a Puppet::Transaction::Report as serialized to YAML by
+// Puppet 3. Ruby tags are ignored by the YAML decoder.
+type httpReport struct {
+	Host                 string                      `yaml:"host"`
+	Time                 string                      `yaml:"time"`
+	Kind                 string                      `yaml:"kind"`
+	Status               string                      `yaml:"status"`
+	PuppetVersion        string                      `yaml:"puppet_version"`
+	ReportFormat         int                         `yaml:"report_format"`
+	ConfigurationVersion string                      `yaml:"configuration_version"`
+	TransactionUUID      string                      `yaml:"transaction_uuid"`
+	Environment          string                      `yaml:"environment"`
+	Logs                 []httpReportLog             `yaml:"logs"`
+	Metrics              map[string]httpReportMetric `yaml:"metrics"`
+	ResourceStatuses     map[string]httpReportStatus `yaml:"resource_statuses"`
+}
+
+type httpReportLog struct {
+	Level   string   `yaml:"level"`
+	Message string   `yaml:"message"`
+	Source  string   `yaml:"source"`
+	Tags    rubyTags `yaml:"tags"`
+	Time    string   `yaml:"time"`
+	File    string   `yaml:"file"`
+	Line    int      `yaml:"line"`
+}
+
+// httpReportMetric holds the values of a metric category as
+// [name, label, value] triples.
+type httpReportMetric struct {
+	Name   string          `yaml:"name"`
+	Values [][]interface{} `yaml:"values"`
+}
+
+type httpReportStatus struct {
+	Resource        string            `yaml:"resource"`
+	ResourceType    string            `yaml:"resource_type"`
+	Title           string            `yaml:"title"`
+	File            string            `yaml:"file"`
+	Line            int               `yaml:"line"`
+	Time            string            `yaml:"time"`
+	Skipped         bool              `yaml:"skipped"`
+	Failed          bool              `yaml:"failed"`
+	Changed         bool              `yaml:"changed"`
+	OutOfSync       bool              `yaml:"out_of_sync"`
+	Tags            rubyTags          `yaml:"tags"`
+	ContainmentPath []string          `yaml:"containment_path"`
+	Events          []httpReportEvent `yaml:"events"`
+}
+
+type httpReportEvent struct {
+	Property      string      `yaml:"property"`
+	PreviousValue interface{} `yaml:"previous_value"`
+	DesiredValue  interface{} `yaml:"desired_value"`
+	Message       string      `yaml:"message"`
+	Name          string      `yaml:"name"`
+	Status        string      `yaml:"status"`
+	Time          string      `yaml:"time"`
+}
+
+// rubyTags are the tags of a log or resource status. Puppet 3.4 and later
+// write them as a Puppet::Util::TagSet, a Ruby Set holding the tags as the
+// keys of its hash, older versions as a sequence.
+type rubyTags []string
+
+func (t *rubyTags) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var tags []string
+	if err := unmarshal(&tags); err == nil {
+		*t = tags
+		return nil
+	}
+	var set struct {
+		Hash yaml.MapSlice `yaml:"hash"`
+	}
+	if err := unmarshal(&set); err != nil {
+		return err
+	}
+	tags = []string{}
+	for _, item := range set.Hash {
+		tags = append(tags, fmt.Sprint(item.Key))
+	}
+	*t = tags
+	return nil
+}
+
+// Time formats of Ruby YAML timestamps.
+var rubyTimeLayouts = []string{
+	"2006-01-02 15:04:05.999999999 -07:00",
+	"2006-01-02 15:04:05.999999999 -07:00:00",
+	"2006-01-02 15:04:05.999999999 Z",
+	"2006-01-02 15:04:05.999999999Z",
+	time.RFC3339Nano,
+}
+
+func (s *server) httpReportsHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		s.Log.Errorf("failed to read request body: %v", err)
+		return
+	}
+
+	var v3c v3Commands
+	v3c.Command = httpReportCommand
+	v3c.Version = 1
+	v3c.Payload, err = json.Marshal(string(body))
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		s.Log.Errorf("failed to encode report: %v", err)
+		return
+	}
+
+	data, stage, err := processCommand(v3c)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		s.Log.Errorf("failed to %s %s command: %v", stage, v3c.Command, err)
+		command, _ := json.Marshal(&v3c)
+		s.storeDeadLetter(command, v3c, stage, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(data)
+}
+
+// parseHTTPReport decodes the YAML report from the payload of an http report command.
+func parseHTTPReport(payload json.RawMessage) (httpReport, error) {
+	var doc string
+	if err := json.Unmarshal(payload, &doc); err != nil {
+		return httpReport{}, err
+	}
+	var hr httpReport
+	if err := yaml.Unmarshal([]byte(doc), &hr); err != nil {
+		return httpReport{}, fmt.Errorf("failed to decode YAML report: %v", err)
+	}
+	if hr.Host == "" {
+		return httpReport{}, fmt.Errorf("report has no host")
+	}
+	return hr, nil
+}
+
+// httpReportCertname returns the host of the YAML report, if any.
+func httpReportCertname(payload json.RawMessage) string {
+	hr, err := parseHTTPReport(payload)
+	if err != nil {
+		return ""
+	}
+	return hr.Host
+}
+
+func getV4HTTPReportPayload(payload json.RawMessage) (json.RawMessage, url.Values, *v4Report, error) {
+	hr, err := parseHTTPReport(payload)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var report = httpToV4ReportConv(hr)
+	catalogHistory.mark(&report)
+
+	v := url.Values{}
+	v.Set("certname", report.Certname)
+	v.Set("producer-timestamp", report.ProducerTimestamp)
+
+	j, err := json.Marshal(&report)
+	return j, v, &report, err
+}
+
+func httpToV4ReportConv(hr httpReport) v4Report {
+	var v4r v4Report
+	v4r.Certname = hr.Host
+	v4r.Environment, v4r.Producer = conf().rewrite(hr.Host)
+	v4r.PuppetVersion = hr.PuppetVersion
+	v4r.ReportFormat = 8
+	v4r.ProducerTimestamp = time.Now().Format(time.RFC3339)
+	v4r.ConfigurationVersion = hr.ConfigurationVersion
+	v4r.TransactionUUID = hr.TransactionUUID
+	v4r.CatalogUUID, v4r.CachedCatalogStatus = catalogIDs.report(hr.Host, hr.TransactionUUID)
+	// PuppetDB rejects null resources, logs and metrics.
+	v4r.Resources = v4Resources{}
+	v4r.Logs = v4Logs{}
+	v4r.Metrics = v4Metrics{}
+
+	// The report time is the start of the run, the end is not recorded.
+	start := rubyTime(hr.Time, time.Now())
+	v4r.StartTime = start.Format(time.RFC3339Nano)
+	v4r.EndTime = start.Add(time.Duration(hr.metric("time", "total") * float64(time.Second))).Format(time.RFC3339Nano)
+
+	for _, l := range hr.Logs {
+		var v4l v4Log
+		v4l.File = l.File
+		v4l.Line = l.Line
+		v4l.Level = l.Level
+		v4l.Message = l.Message
+		v4l.Source = l.Source
+		v4l.Tags = []string(l.Tags)
+		if v4l.Tags == nil {
+			v4l.Tags = []string{}
+		}
+		v4l.Time = rubyTime(l.Time, start).Format(time.RFC3339Nano)
+		v4r.Logs = append(v4r.Logs, v4l)
+	}
+
+	for category, m := range hr.Metrics {
+		for _, value := range m.Values {
+			name, v, ok := metricValue(value)
+			if !ok {
+				continue
+			}
+			v4r.Metrics = append(v4r.Metrics, v4Metric{Category: category, Name: name, Value: v})
+		}
+	}
+	sort.Slice(v4r.Metrics, func(i, j int) bool {
+		if v4r.Metrics[i].Category != v4r.Metrics[j].Category {
+			return v4r.Metrics[i].Category < v4r.Metrics[j].Category
+		}
+		return v4r.Metrics[i].Name < v4r.Metrics[j].Name
+	})
+
+	var resources []string
+	for resource := range hr.ResourceStatuses {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+	for _, resource := range resources {
+		rs := hr.ResourceStatuses[resource]
+		var v4res v4Resource
+		v4res.ResourceType, v4res.ResourceTitle = rs.ResourceType, rs.Title
+		if v4res.ResourceType == "" {
+			v4res.ResourceType, v4res.ResourceTitle = splitResource(resource)
+		}
+		v4res.TimeStamp = rubyTime(rs.Time, start).Format(time.RFC3339Nano)
+		v4res.Skipped = rs.Skipped
+		v4res.File = rs.File
+		v4res.Line = rs.Line
+		v4res.ContainmentPath = rs.ContainmentPath
+		if v4res.ContainmentPath == nil {
+			v4res.ContainmentPath = []string{}
+		}
+		v4res.Events = []v4ResourceEventExpanded{}
+
+		for _, e := range rs.Events {
+			var v4ree v4ResourceEventExpanded
+			v4ree.Status = e.Status
+			v4ree.TimeStamp = rubyTime(e.Time, start).Format(time.RFC3339Nano)
+			v4ree.ResourceType = v4res.ResourceType
+			v4ree.ResourceTitle = v4res.ResourceTitle
+			v4ree.File = v4res.File
+			v4ree.Line = v4res.Line
+			v4ree.ContainmentPath = v4res.ContainmentPath
+			v4ree.Property = e.Property
+			v4ree.OldValue = yamlValueJSON(e.PreviousValue)
+			v4ree.NewValue = yamlValueJSON(e.DesiredValue)
+			v4ree.Message = e.Message
+			v4res.Events = append(v4res.Events, v4ree)
+			if e.Status == "skipped" {
+				v4res.Skipped = true
+			}
+		}
+
+		v4r.Resources = append(v4r.Resources, v4res)
+	}
+	inferRunStatus(&v4r, hr.Status)
+
+	return v4r
+}
+
+// metric returns the value of a metric, 0 if the report doesn't have it.
+func (hr httpReport) metric(category, name string) float64 {
+	for _, value := range hr.Metrics[category].Values {
+		if n, v, ok := metricValue(value); ok && n == name {
+			return v
+		}
+	}
+	return 0
+}
+
+// metricValue returns the name and value of a [name, label, value] triple.
+func metricValue(value []interface{}) (string, float64, bool) {
+	if len(value) != 3 {
+		return "", 0, false
+	}
+	name := fmt.Sprint(value[0])
+	switch v := value[2].(type) {
+	case int:
+		return name, float64(v), true
+	case float64:
+		return name, v, true
+	}
+	return "", 0, false
+}
+
+// rubyTime parses a Ruby YAML timestamp, def if it can't.
+func rubyTime(s string, def time.Time) time.Time {
+	for _, layout := range rubyTimeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return def
+}
+
+// splitResource splits a resource reference like File[/etc/motd] into its type and title.
+func splitResource(ref string) (string, string) {
+	i := strings.Index(ref, "[")
+	if i < 0 || !strings.HasSuffix(ref, "]") {
+		return ref, ""
+	}
+	return ref[:i], ref[i+1 : len(ref)-1]
+}
+
+// yamlValueJSON encodes a decoded YAML value as JSON, converting the maps
+// with interface{} keys the YAML decoder returns.
+func yamlValueJSON(v interface{}) json.RawMessage {
+	j, err := json.Marshal(jsonCompatible(v))
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return j
+}
+
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(val)
+		}
+		return m
+	case []interface{}:
+		for i, val := range v {
+			v[i] = jsonCompatible(val)
+		}
+		return v
+	}
+	return v
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestRubyTags(t *testing.T) {
+	tests := []struct {
+		name string
+		doc  string
+		want rubyTags
+	}{
+		{"sequence", "tags:\n  - notice\n  - file\n", rubyTags{"notice", "file"}},
+		{"tag set", "tags: !ruby/object:Puppet::Util::TagSet\n  hash:\n    notice: true\n    file: true\n", rubyTags{"notice", "file"}},
+		{"empty tag set", "tags: !ruby/object:Puppet::Util::TagSet\n  hash: {}\n", rubyTags{}},
+		{"missing", "other: 1\n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v struct {
+				Tags rubyTags `yaml:"tags"`
+			}
+			if err := yaml.Unmarshal([]byte(tt.doc), &v); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(v.Tags, tt.want) {
+				t.Errorf("got %#v, want %#v", v.Tags, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePuppet3Report(t *testing.T) {
+	setConfig(&config{})
+	doc, err := ioutil.ReadFile("testdata/puppet3-report.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := json.Marshal(string(doc))
+
+	hr, err := parseHTTPReport(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hr.Host != "web01.example.com" || hr.ConfigurationVersion != "1463041262" {
+		t.Errorf("got host %q configuration version %q", hr.Host, hr.ConfigurationVersion)
+	}
+	if tags := hr.ResourceStatuses["File[/etc/motd]"].Tags; !reflect.DeepEqual(tags, rubyTags{"file", "class", "motd"}) {
+		t.Errorf("got resource tags %v", tags)
+	}
+
+	r := httpToV4ReportConv(hr)
+	if len(r.Logs) != 2 {
+		t.Fatalf("got %d logs, want 2", len(r.Logs))
+	}
+	if want := []string{"notice", "file", "class", "motd"}; !reflect.DeepEqual(r.Logs[0].Tags, want) {
+		t.Errorf("got log tags %v, want %v", r.Logs[0].Tags, want)
+	}
+	if len(r.Resources) != 2 {
+		t.Fatalf("got %d resources, want 2", len(r.Resources))
+	}
+	res := r.Resources[0]
+	if res.ResourceType != "File" || res.ResourceTitle != "/etc/motd" || len(res.Events) != 1 {
+		t.Errorf("got resource %s[%s] with %d events", res.ResourceType, res.ResourceTitle, len(res.Events))
+	}
+	if r.Status != "changed" {
+		t.Errorf("got status %q, want changed", r.Status)
+	}
+}
+
+func TestHTTPToV4ReportConvEmpty(t *testing.T) {
+	setConfig(&config{})
+	tests := []struct {
+		name string
+		doc  string
+	}{
+		{"no resources", "--- !ruby/object:Puppet::Transaction::Report\nhost: web01.example.com\nstatus: unchanged\n"},
+		{"empty sections", "--- !ruby/object:Puppet::Transaction::Report\nhost: web01.example.com\nstatus: unchanged\nlogs: []\nmetrics: {}\nresource_statuses: {}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload, _ := json.Marshal(tt.doc)
+			hr, err := parseHTTPReport(payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			j, err := json.Marshal(httpToV4ReportConv(hr))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range []string{`"resources":[]`, `"logs":[]`, `"metrics":[]`} {
+				if !strings.Contains(string(j), want) {
+					t.Errorf("got %s, want %s", j, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	reportResourcesAdded = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_report_resources_added_total",
+			Help: "Unchanged resources added to reports from the last catalog of the node.",
+		},
+	)
+	lastCatalogsDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_report_resources_catalogs_dropped_total",
+			Help: "Catalogs not kept for completing reports, partitioned by the limit reached: max_nodes or max_resources.",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(reportResourcesAdded)
+	prometheus.MustRegister(lastCatalogsDropped)
+}
+
+// lastCatalogs completes the reports with the resources of the last catalog
+// of the nodes. It is nil outside of the server.
+var lastCatalogs *lastCatalogStore
+
+// lastCatalogStore keeps the resources of the last catalog of every node,
+// without their parameters.
+type lastCatalogStore struct {
+	mu    sync.Mutex
+	nodes map[string]lastCatalog
+}
+
+// lastCatalog is the last catalog of a node, with the transaction UUID of
+// the run it was compiled for.
+type lastCatalog struct {
+	transactionUUID string
+	resources       []lastResource
+}
+
+// containerTypes are the catalog resources Puppet doesn't report, they are
+// kept for the containment paths only.
+var containerTypes = []string{"Class", "Stage", "Node"}
+
+// lastResource is a catalog resource. Parent is the index of the resource
+// containing it, -1 for none.
+type lastResource struct {
+	resourceType string
+	title        string
+	file         string
+	line         int
+	parent       int
+}
+
+func newLastCatalogStore() *lastCatalogStore {
+	return &lastCatalogStore{nodes: make(map[string]lastCatalog)}
+}
+
+// observe keeps the resources of the converted catalog, replacing the
+// previous catalog of the node.
+func (s *lastCatalogStore) observe(c *v4Catalog) {
+	if s == nil {
+		return
+	}
+	cfg := conf().ReportResources
+	if !cfg.Enabled {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, known := s.nodes[c.Certname]
+	if cfg.MaxResources > 0 && len(c.Resources) > cfg.MaxResources {
+		lastCatalogsDropped.WithLabelValues("max_resources").Inc()
+		// Don't complete reports with the resources of an older catalog.
+		delete(s.nodes, c.Certname)
+		return
+	}
+	if !known && cfg.MaxNodes > 0 && len(s.nodes) >= cfg.MaxNodes {
+		lastCatalogsDropped.WithLabelValues("max_nodes").Inc()
+		return
+	}
+
+	index := make(map[resourceSpec]int, len(c.Resources))
+	var resources []lastResource
+	for _, res := range c.Resources {
+		// Exported resources are not applied by the node.
+		if res.Exported {
+			continue
+		}
+		index[resourceSpec{Type: res.Type, Title: res.Title}] = len(resources)
+		resources = append(resources, lastResource{
+			resourceType: res.Type,
+			title:        res.Title,
+			file:         res.File,
+			line:         res.Line,
+			parent:       -1,
+		})
+	}
+	for _, e := range c.Edges {
+		if e.Relationship != "contains" {
+			continue
+		}
+		parent, ok := index[e.Source]
+		child, ok2 := index[e.Target]
+		if ok && ok2 && parent != child {
+			resources[child].parent = parent
+		}
+	}
+	s.nodes[c.Certname] = lastCatalog{transactionUUID: c.TransactionUUID, resources: resources}
+}
+
+// complete adds the resources of the last catalog of the node that have no
+// events in the report as unchanged resources, except classes, stages and
+// nodes, like Puppet reports. Only the reports of the run the catalog was
+// compiled for are completed: a failed run may not have applied it, and
+// another run applied another catalog.
+func (s *lastCatalogStore) complete(r *v4Report) {
+	if s == nil || !conf().ReportResources.Enabled {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.nodes[r.Certname]
+	if !ok {
+		return
+	}
+	if r.Status == "failed" {
+		traces.tracef(r.Certname, "report of a failed run not completed with the resources of the last catalog")
+		return
+	}
+	if r.TransactionUUID == "" || r.TransactionUUID != c.transactionUUID {
+		traces.tracef(r.Certname, "report of transaction %q not completed with the last catalog of transaction %q", r.TransactionUUID, c.transactionUUID)
+		return
+	}
+	resources := c.resources
+	reported := make(map[resourceSpec]bool, len(r.Resources))
+	for _, res := range r.Resources {
+		reported[resourceSpec{Type: res.ResourceType, Title: res.ResourceTitle}] = true
+	}
+	for i, res := range resources {
+		if reported[resourceSpec{Type: res.resourceType, Title: res.title}] || contains(containerTypes, res.resourceType) {
+			continue
+		}
+		r.Resources = append(r.Resources, v4Resource{
+			ResourceType:    res.resourceType,
+			ResourceTitle:   res.title,
+			TimeStamp:       r.StartTime,
+			File:            res.file,
+			Line:            res.line,
+			ContainmentPath: containmentPath(resources, i),
+			Events:          []v4ResourceEventExpanded{},
+		})
+		reportResourcesAdded.Inc()
+	}
+}
+
+// forget drops the catalog of the node, e.g. when it is deactivated.
+func (s *lastCatalogStore) forget(certname string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.nodes, certname)
+}
+
+// prune drops all catalogs when completing reports is disabled.
+func (s *lastCatalogStore) prune() {
+	if s == nil || conf().ReportResources.Enabled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nodes = make(map[string]lastCatalog)
+}
+
+// containmentPath returns the containment path of the resource the way
+// Puppet reports it, e.g. [Stage[main], Motd, File[/etc/motd]]: classes
+// by their name, other resources by their reference.
+func containmentPath(resources []lastResource, i int) []string {
+	var path []string
+	// The depth is bounded in case of a containment cycle.
+	for depth := 0; i >= 0 && depth <= len(resources); depth++ {
+		res := resources[i]
+		name := res.resourceType + "[" + res.title + "]"
+		if res.resourceType == "Class" {
+			name = res.title
+		}
+		path = append([]string{name}, path...)
+		i = res.parent
+	}
+	return path
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLastCatalogsComplete(t *testing.T) {
+	setConfig(&config{ReportResources: reportResourcesConfig{Enabled: true}})
+
+	spec := func(t, title string) resourceSpec { return resourceSpec{Type: t, Title: title} }
+	catalog := &v4Catalog{
+		Certname:        "web01.example.com",
+		TransactionUUID: "tx-1",
+		Resources: catalogResources{
+			{Type: "Stage", Title: "main"},
+			{Type: "Class", Title: "Settings"},
+			{Type: "Class", Title: "main"},
+			{Type: "Node", Title: "default"},
+			{Type: "Class", Title: "Motd"},
+			{Type: "File", Title: "/etc/motd"},
+			{Type: "Service", Title: "ntpd"},
+			{Type: "Filebucket", Title: "puppet"},
+			{Type: "Sshkey", Title: "web01", Exported: true},
+		},
+		Edges: catalogEdges{
+			{Relationship: "contains", Source: spec("Stage", "main"), Target: spec("Class", "main")},
+			{Relationship: "contains", Source: spec("Class", "main"), Target: spec("Node", "default")},
+			{Relationship: "contains", Source: spec("Node", "default"), Target: spec("Class", "Motd")},
+			{Relationship: "contains", Source: spec("Class", "Motd"), Target: spec("File", "/etc/motd")},
+			{Relationship: "contains", Source: spec("Class", "Motd"), Target: spec("Service", "ntpd")},
+			{Relationship: "contains", Source: spec("Class", "main"), Target: spec("Filebucket", "puppet")},
+		},
+	}
+	store := newLastCatalogStore()
+	store.observe(catalog)
+
+	r := &v4Report{
+		Certname:        "web01.example.com",
+		TransactionUUID: "tx-1",
+		Status:          "changed",
+		Resources: v4Resources{
+			{ResourceType: "File", ResourceTitle: "/etc/motd", Events: []v4ResourceEventExpanded{{Status: "success"}}},
+		},
+	}
+	store.complete(r)
+
+	// A Puppet 4 report of this catalog has the file, the service and the
+	// filebucket: no classes, stages, nodes or exported resources.
+	_, resources := reportCounts(r)
+	want := map[string]float64{"total": 3, "changed": 1, "failed": 0, "skipped": 0, "out_of_sync": 1}
+	if !reflect.DeepEqual(resources, want) {
+		t.Errorf("got resources %v, want %v", resources, want)
+	}
+	var service *v4Resource
+	for i := range r.Resources {
+		if r.Resources[i].ResourceType == "Service" {
+			service = &r.Resources[i]
+		}
+	}
+	if service == nil {
+		t.Fatal("Service[ntpd] not added")
+	}
+	path := []string{"Stage[main]", "main", "Node[default]", "Motd", "Service[ntpd]"}
+	if !reflect.DeepEqual(service.ContainmentPath, path) {
+		t.Errorf("got containment path %v, want %v", service.ContainmentPath, path)
+	}
+}
+
+func TestLastCatalogsCompleteSkipped(t *testing.T) {
+	setConfig(&config{ReportResources: reportResourcesConfig{Enabled: true}})
+	store := newLastCatalogStore()
+	store.observe(&v4Catalog{
+		Certname:        "web01.example.com",
+		TransactionUUID: "tx-1",
+		Resources:       catalogResources{{Type: "File", Title: "/etc/motd"}, {Type: "Service", Title: "ntpd"}},
+	})
+
+	tests := []struct {
+		name            string
+		certname        string
+		transactionUUID string
+		status          string
+		want            int
+	}{
+		{"transaction of the catalog", "web01.example.com", "tx-1", "unchanged", 2},
+		{"other transaction", "web01.example.com", "tx-2", "unchanged", 0},
+		{"no transaction", "web01.example.com", "", "unchanged", 0},
+		{"failed run", "web01.example.com", "tx-1", "failed", 0},
+		{"unknown node", "db01.example.com", "tx-1", "unchanged", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &v4Report{Certname: tt.certname, TransactionUUID: tt.transactionUUID, Status: tt.status}
+			store.complete(r)
+			if len(r.Resources) != tt.want {
+				t.Errorf("got %d resources, want %d", len(r.Resources), tt.want)
+			}
+		})
+	}
+}
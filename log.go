@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
 	"net/http"
 	"os"
+	"path"
+	"sort"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -28,6 +32,11 @@ func (w *statusWriter) Write(b []byte) (int, error) {
 	return n, err
 }
 
+// Unwrap lets http.ResponseController reach the connection, e.g. for streams.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
 func (s *server) logHTTP(handler http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
@@ -39,13 +48,121 @@ func (s *server) logHTTP(handler http.Handler) http.Handler {
 	})
 }
 
+// checkACL rejects requests from addresses not allowed by the config.
+func (s *server) checkACL(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !conf().allowed(r.RemoteAddr) {
+			w.WriteHeader(http.StatusForbidden)
+			s.Log.Warnf("request from %s denied by ACL", r.RemoteAddr)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
 func (s *server) initLogger() {
 	s.Log = log.New()
 	s.Log.SetFormatter(&log.JSONFormatter{})
-	file, err := os.OpenFile(opts.LogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(conf().Log.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		s.Log.Fatal(err)
 	}
 	s.Log.Out = file
-	s.Log.SetLevel(log.Level(opts.LogLevel))
+	s.Log.SetLevel(log.Level(conf().Log.Level))
+	s.onShutdown("log file", func(ctx context.Context) error {
+		s.Log.Info("Shutdown complete")
+		return file.Close()
+	})
+
+	traces = newTracer(s.Log)
+	traces.set(conf().Trace)
+}
+
+// traces logs commands of selected nodes. It is nil outside of the server.
+var traces *tracer
+
+// tracer logs the processing of commands for nodes matching certname globs,
+// regardless of the current log level.
+type tracer struct {
+	mu      sync.RWMutex
+	targets map[string]bool
+	log     *log.Logger
+}
+
+func newTracer(l *log.Logger) *tracer {
+	t := new(tracer)
+	t.targets = make(map[string]bool)
+	t.log = log.New()
+	t.log.Out = l.Out
+	t.log.Formatter = l.Formatter
+	t.log.SetLevel(log.TraceLevel)
+	return t
+}
+
+func (t *tracer) match(certname string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for p := range t.targets {
+		if ok, _ := path.Match(p, certname); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tracef logs a trace message if the certname is traced.
+func (t *tracer) tracef(certname, format string, args ...interface{}) {
+	if !t.match(certname) {
+		return
+	}
+	t.log.WithField("certname", certname).Tracef(format, args...)
+}
+
+// set replaces the traced certname globs, dropping changes made at runtime.
+func (t *tracer) set(patterns []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.targets = make(map[string]bool)
+	for _, p := range patterns {
+		t.targets[p] = true
+	}
+}
+
+func (t *tracer) add(pattern string) error {
+	if err := checkPattern(pattern); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.targets[pattern] = true
+	return nil
+}
+
+func (t *tracer) remove(pattern string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.targets[pattern] {
+		return false
+	}
+	delete(t.targets, pattern)
+	return true
+}
+
+// list returns the traced certname globs.
+func (t *tracer) list() []string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	var l = []string{}
+	for p := range t.targets {
+		l = append(l, p)
+	}
+	sort.Strings(l)
+	return l
 }
@@ -1,10 +1,9 @@
 package main
 
 import (
-	"crypto/tls"
 	"fmt"
-	"net/http"
 	"os"
+	"time"
 
 	"github.com/jessevdk/go-flags"
 )
@@ -15,23 +14,92 @@ var (
 )
 
 var opts struct {
-	ListenAddress string `short:"a" long:"listen.address" default:"127.0.0.1" description:"Listen address"`
-	ListenPort    int    `short:"p" long:"port" default:"8088" description:"Listen port"`
-	PuppetDBURL   string `short:"u" long:"puppetdb.url" default:"https://puppetdb.example.com" description:"URL for connection to PuppetDB"`
-	Environment   string `short:"e" long:"environment" default:"production" description:"Change 'environment' field"`
-	Producer      string `short:"P" long:"producer" default:"puppet.example.com" description:"Change 'producer' field"`
-	Insecure      bool   `short:"k" long:"insecure" description:"Disable verify the server's certificate chain and hostname"`
-	LogFile       string `short:"L" long:"log.file" default:"/var/log/puppetdb-proxy.log" description:"Path to logfile"`
-	LogLevel      int    `short:"V" long:"log.level" default:"4" description:"Log level (0-6)"`
-	Version       bool   `short:"v" long:"version" description:"Show version number and quit"`
-	DumpHostname  string `short:"H" long:"dump.hostname" description:"Hostname of Puppet node for dumping the commands payload to file /tmp/$hostname-$command.json (use with -C|-F|-R options)"`
-	DumpReport    bool   `short:"R" long:"dump.report" description:"Dump the command store report payload to file (use with -H option)"`
-	DumpFacts     bool   `short:"F" long:"dump.facts" description:"Dump the command replace facts payload to file (use with -H option)"`
-	DumpCatalog   bool   `short:"C" long:"dump.catalog" description:"Dump the command replace catalog payload to file (use with -H option)"`
+	ListenAddress             string        `short:"a" long:"listen.address" default:"127.0.0.1" description:"Listen address"`
+	ListenPort                int           `short:"p" long:"port" default:"8088" description:"Listen port"`
+	ReadTimeout               time.Duration `long:"server.read-timeout" default:"60s" description:"Maximum duration for reading the entire request"`
+	WriteTimeout              time.Duration `long:"server.write-timeout" default:"60s" description:"Maximum duration before timing out writes of the response"`
+	IdleTimeout               time.Duration `long:"server.idle-timeout" default:"120s" description:"Maximum duration to wait for the next request on a keep-alive connection"`
+	ShutdownTimeout           time.Duration `long:"server.shutdown-timeout" default:"30s" description:"Maximum duration to drain in-flight requests on shutdown"`
+	ConfigFile                string        `short:"c" long:"config" description:"Path to YAML configuration file, its settings override the options (reloaded on SIGHUP)"`
+	PuppetDBURL               string        `short:"u" long:"puppetdb.url" default:"https://puppetdb.example.com" description:"URL for connection to PuppetDB"`
+	PuppetDBCA                string        `long:"puppetdb.ca" description:"Path to CA certificate for verify PuppetDB"`
+	PuppetDBCert              string        `long:"puppetdb.cert" description:"Path to client certificate for connection to PuppetDB"`
+	PuppetDBKey               string        `long:"puppetdb.key" description:"Path to client private key for connection to PuppetDB"`
+	Environment               string        `short:"e" long:"environment" default:"production" description:"Change 'environment' field"`
+	Producer                  string        `short:"P" long:"producer" default:"puppet.example.com" description:"Change 'producer' field"`
+	Insecure                  bool          `short:"k" long:"insecure" description:"Disable verify the server's certificate chain and hostname"`
+	LogFile                   string        `short:"L" long:"log.file" default:"/var/log/puppetdb-proxy.log" description:"Path to logfile"`
+	LogLevel                  int           `short:"V" long:"log.level" default:"4" description:"Log level (0-6)"`
+	Version                   bool          `short:"v" long:"version" description:"Show version number and quit"`
+	DumpHostname              []string      `short:"H" long:"dump.hostname" description:"Certname glob of Puppet nodes for dumping the commands payload to files in --dump.dir (can be repeated, use with -C|-F|-R|-Q options)"`
+	DumpReport                bool          `short:"R" long:"dump.report" description:"Dump the command store report payload to file (use with -H option)"`
+	DumpFacts                 bool          `short:"F" long:"dump.facts" description:"Dump the command replace facts payload to file (use with -H option)"`
+	DumpCatalog               bool          `short:"C" long:"dump.catalog" description:"Dump the command replace catalog payload to file (use with -H option)"`
+	DumpDeactivate            bool          `long:"dump.deactivate" description:"Dump the command deactivate node payload to file (use with -H option)"`
+	DumpQuery                 bool          `short:"Q" long:"dump.query" description:"Dump the query (use with -H option)"`
+	DumpDir                   string        `long:"dump.dir" default:"/tmp/puppetdb-proxy" description:"Directory for dump files"`
+	DumpMaxSize               int64         `long:"dump.max-size" default:"10485760" description:"Start a new dump file when it grows over this size in bytes"`
+	DumpRetention             int           `long:"dump.retention" default:"10" description:"Number of dump files kept for each node and command"`
+	DeadLetterDir             string        `short:"D" long:"deadletter.dir" description:"Directory for commands that failed conversion or submission (disabled if empty)"`
+	AdminAddress              string        `long:"admin.address" description:"Listen address and port of the admin API, e.g. 127.0.0.1:8089 (disabled if empty)"`
+	HealthCacheTTL            time.Duration `long:"health.cache-ttl" default:"10s" description:"How long the PuppetDB readiness probe result is cached"`
+	HealthTimeout             time.Duration `long:"health.timeout" default:"5s" description:"Timeout of the PuppetDB readiness probe"`
+	HealthMinFreeBytes        uint64        `long:"health.min-free-bytes" default:"104857600" description:"Minimum free space in the dead letter and dump directories for readiness"`
+	HealthSpoolMaxEntries     int           `long:"health.spool-max-entries" description:"Maximum number of commands in the dead letter directory for readiness (no limit if 0)"`
+	NodeMetrics               bool          `long:"metrics.nodes" description:"Export Puppet run metrics of every node from its reports"`
+	NodeMetricsCertnames      []string      `long:"metrics.nodes.certname" description:"Certname glob of nodes to export run metrics for (can be repeated, all nodes if not set)"`
+	NodeMetricsMaxNodes       int           `long:"metrics.nodes.max" default:"5000" description:"Maximum number of nodes to export run metrics for (no limit if 0)"`
+	CorrectiveChange          bool          `long:"corrective-change" description:"Flag report events as corrective changes when the catalog of the run did not change their resource"`
+	CorrectiveChangeMaxNodes  int           `long:"corrective-change.max-nodes" default:"10000" description:"Maximum number of nodes to keep the last catalog of for corrective changes (no limit if 0)"`
+	CatalogUUIDsMax           int           `long:"catalog-uuids.max" default:"10000" description:"Maximum number of catalogs to keep the catalog UUID of for their reports (disabled if 0)"`
+	CatalogUUIDsFile          string        `long:"catalog-uuids.file" description:"File to keep the catalog UUIDs in across restarts (in memory only if empty)"`
+	ReportResources           bool          `long:"report.resources" description:"Add the resources of the last catalog of the node to its reports as unchanged resources"`
+	ReportResourcesMaxNodes   int           `long:"report.resources.max-nodes" default:"1000" description:"Maximum number of nodes to keep the last catalog of for reports (no limit if 0)"`
+	ReportResourcesMaxCount   int           `long:"report.resources.max-resources" default:"20000" description:"Don't keep catalogs with more resources for reports (no limit if 0)"`
+	CatalogValidation         string        `long:"catalog.validation" default:"repair" choice:"repair" choice:"reject" choice:"ignore" description:"Action on problems PuppetDB rejects catalogs for"`
+	CatalogMaxValueSize       int           `long:"catalog.max-value-size" description:"Replace catalog parameter values larger than this many bytes by their SHA-256 and length (disabled if 0)"`
+	CatalogTopResources       int           `long:"catalog.top-resources" default:"5" description:"Number of largest resources logged for catalogs with replaced values"`
+	CatalogSizeMaxNodes       int           `long:"catalog.max-nodes" default:"1000" description:"Maximum number of nodes to export the largest resource of catalogs with replaced values for (no limit if 0)"`
+	FactsExclude              []string      `long:"facts.exclude" description:"Regexp of fact names to drop from replace facts commands (can be repeated)"`
+	FactsCoerce               bool          `long:"facts.coerce" description:"Coerce the known string facts of Facter 1.x and 2.x to booleans, numbers and structured facts"`
+	StreamBuffer              int           `long:"stream.buffer" default:"100" description:"Events buffered for a slow stream subscriber before dropping them"`
+	StreamMaxSubscribers      int           `long:"stream.max-subscribers" default:"100" description:"Maximum number of stream subscribers (no limit if 0)"`
+	StreamKeepalive           time.Duration `long:"stream.keepalive" default:"15s" description:"Interval of keepalive comments on idle streams"`
+	AlertsWebhooks            []string      `long:"alerts.webhook" description:"URL receiving webhook alerts on failed runs (can be repeated)"`
+	AlertsConsecutiveFailures int           `long:"alerts.consecutive-failures" default:"3" description:"Number of failed runs in a row to alert on (disabled if 0)"`
+	AlertsNotReportingAfter   time.Duration `long:"alerts.not-reporting-after" description:"Alert on nodes not reporting for this long (disabled if 0)"`
+	AlertsDedupWindow         time.Duration `long:"alerts.dedup-window" default:"1h" description:"Suppress repeated alerts of a node with the same trigger within this window"`
+	AlertsRetries             int           `long:"alerts.retries" default:"3" description:"Number of retries of a failed webhook request"`
+	SinkFile                  string        `long:"sink.file" description:"Append the converted commands as JSON lines to this file"`
+	SinkStdout                bool          `long:"sink.stdout" description:"Write the converted commands as JSON lines to stdout"`
+	ForemanURL                string        `long:"foreman.url" description:"URL of Foreman to send the reports to as config reports, e.g. https://foreman.example.com"`
+	ForemanCA                 string        `long:"foreman.ca" description:"Path to CA certificate for verify Foreman"`
+	ForemanCert               string        `long:"foreman.cert" description:"Path to client certificate for connection to Foreman"`
+	ForemanKey                string        `long:"foreman.key" description:"Path to client private key for connection to Foreman"`
+	StatsDAddress             string        `long:"statsd.address" description:"StatsD address to send run metrics of the nodes to over UDP, e.g. 127.0.0.1:8125"`
+	GraphiteAddress           string        `long:"graphite.address" description:"Graphite address to send run metrics of the nodes to over TCP, e.g. 127.0.0.1:2003"`
+	MetricTemplate            string        `long:"statsd.template" default:"puppet.{{.Certname}}.{{.Metric}}" description:"Template of the StatsD and Graphite metric names"`
+	AdminToken                string        `long:"admin.token" env:"PUPPETDB_PROXY_ADMIN_TOKEN" description:"Bearer token required by the admin API"`
 }
 
+var deadLetterCmd deadLetterCommand
+
 func main() {
-	if _, err := flags.Parse(&opts); err != nil {
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	parser.AddCommand("deadletter", "Manage dead-lettered commands",
+		"List, show, retry or delete commands stored in the dead letter directory.", &deadLetterCmd)
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		if command == nil {
+			return nil
+		}
+		if err := initConfig(); err != nil {
+			return err
+		}
+		return command.Execute(args)
+	}
+
+	if _, err := parser.Parse(); err != nil {
 		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
 			os.Exit(0)
 		} else {
@@ -43,12 +111,26 @@ func main() {
 		os.Exit(0)
 	}
 
-	if opts.Insecure {
-		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	if parser.Active != nil {
+		os.Exit(0)
+	}
+
+	if err := initConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
 	s := newServer()
 
-	addr := fmt.Sprintf("%s:%d", opts.ListenAddress, opts.ListenPort)
+	addr := fmt.Sprintf("%s:%d", conf().ListenAddress, conf().ListenPort)
 	s.run(addr)
 }
+
+func initConfig() error {
+	c, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	setConfig(c)
+	return nil
+}
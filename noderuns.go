@@ -0,0 +1,197 @@
+package main
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Run statuses of a Puppet report.
+var runStatuses = []string{"failed", "changed", "unchanged"}
+
+var (
+	nodeLastRun = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "puppetdb_proxy_node_last_run_timestamp_seconds",
+			Help: "End time of the last Puppet run of the node.",
+		},
+		[]string{"certname"},
+	)
+	nodeLastRunStatus = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "puppetdb_proxy_node_last_run_status",
+			Help: "Status of the last Puppet run of the node, 1 for the current status.",
+		},
+		[]string{"certname", "status"},
+	)
+	nodeLastRunEvents = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "puppetdb_proxy_node_last_run_events",
+			Help: "Resource events of the last Puppet run of the node by status (failed, changed or noop).",
+		},
+		[]string{"certname", "status"},
+	)
+	nodePuppetInfo = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "puppetdb_proxy_node_puppet_info",
+			Help: "Puppet version of the node from its last report.",
+		},
+		[]string{"certname", "puppet_version"},
+	)
+	nodeMetricsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_node_metrics_dropped_total",
+			Help: "Reports not exported as node metrics because the node limit was reached.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(nodeLastRun)
+	prometheus.MustRegister(nodeLastRunStatus)
+	prometheus.MustRegister(nodeLastRunEvents)
+	prometheus.MustRegister(nodePuppetInfo)
+	prometheus.MustRegister(nodeMetricsDropped)
+}
+
+// nodeRuns exports run health metrics of nodes from their reports.
+// It is nil outside of the server.
+var nodeRuns *nodeRunMetrics
+
+// nodeRunMetrics keeps track of the nodes with exported series, so that the
+// number of series stays under the configured limit.
+type nodeRunMetrics struct {
+	mu    sync.Mutex
+	nodes map[string]string // certname to puppet version
+}
+
+func newNodeRunMetrics() *nodeRunMetrics {
+	return &nodeRunMetrics{nodes: make(map[string]string)}
+}
+
+// observe exports the metrics of a converted report.
+func (n *nodeRunMetrics) observe(r *v4Report) {
+	if n == nil || r == nil {
+		return
+	}
+	c := conf().NodeMetrics
+	if !c.Enabled || !c.allowed(r.Certname) {
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	version, known := n.nodes[r.Certname]
+	if !known && c.MaxNodes > 0 && len(n.nodes) >= c.MaxNodes {
+		nodeMetricsDropped.Inc()
+		return
+	}
+	if known && version != r.PuppetVersion {
+		nodePuppetInfo.DeleteLabelValues(r.Certname, version)
+	}
+	n.nodes[r.Certname] = r.PuppetVersion
+
+	end, err := time.Parse(time.RFC3339Nano, r.EndTime)
+	if err != nil {
+		end = time.Now()
+	}
+	nodeLastRun.WithLabelValues(r.Certname).Set(float64(end.Unix()))
+
+	status := runStatus(r)
+	for _, s := range runStatuses {
+		var v float64
+		if s == status {
+			v = 1
+		}
+		nodeLastRunStatus.WithLabelValues(r.Certname, s).Set(v)
+	}
+
+	events := map[string]float64{"failed": 0, "changed": 0, "noop": 0}
+	for _, res := range r.Resources {
+		for _, e := range res.Events {
+			switch e.Status {
+			case "failure":
+				events["failed"]++
+			case "success":
+				events["changed"]++
+			case "noop":
+				events["noop"]++
+			}
+		}
+	}
+	for s, v := range events {
+		nodeLastRunEvents.WithLabelValues(r.Certname, s).Set(v)
+	}
+
+	nodePuppetInfo.WithLabelValues(r.Certname, r.PuppetVersion).Set(1)
+}
+
+// forget removes all series of the node, e.g. when it is deactivated.
+func (n *nodeRunMetrics) forget(certname string) {
+	if n == nil {
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.delete(certname)
+}
+
+// prune removes series of nodes no longer allowed by the config.
+func (n *nodeRunMetrics) prune() {
+	if n == nil {
+		return
+	}
+	c := conf().NodeMetrics
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for certname := range n.nodes {
+		if !c.Enabled || !c.allowed(certname) {
+			n.delete(certname)
+		}
+	}
+}
+
+func (n *nodeRunMetrics) delete(certname string) {
+	version, ok := n.nodes[certname]
+	if !ok {
+		return
+	}
+	nodeLastRun.DeleteLabelValues(certname)
+	for _, s := range runStatuses {
+		nodeLastRunStatus.DeleteLabelValues(certname, s)
+	}
+	for _, s := range []string{"failed", "changed", "noop"} {
+		nodeLastRunEvents.DeleteLabelValues(certname, s)
+	}
+	nodePuppetInfo.DeleteLabelValues(certname, version)
+	delete(n.nodes, certname)
+}
+
+// runStatus returns the status sent by the agent, or "unknown" for reports
+// without one. An unknown status is not one of runStatuses, so all status
+// series of the node are set to 0.
+func runStatus(r *v4Report) string {
+	if r.Status == "" {
+		return "unknown"
+	}
+	return r.Status
+}
+
+// allowed reports whether node metrics are exported for the certname.
+func (c nodeMetricsConfig) allowed(certname string) bool {
+	if len(c.Certnames) == 0 {
+		return true
+	}
+	for _, p := range c.Certnames {
+		if ok, _ := path.Match(p, certname); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gaugeValue returns the value of a gauge series.
+func gaugeValue(g *prometheus.GaugeVec, labels ...string) float64 {
+	var m dto.Metric
+	g.WithLabelValues(labels...).Write(&m)
+	return m.GetGauge().GetValue()
+}
+
+func TestNodeRunMetricsObserve(t *testing.T) {
+	events := func(statuses ...string) v4Resources {
+		var res v4Resource
+		for _, s := range statuses {
+			res.Events = append(res.Events, v4ResourceEventExpanded{Status: s})
+		}
+		return v4Resources{res}
+	}
+	tests := []struct {
+		name       string
+		report     v4Report
+		wantStatus map[string]float64
+		wantEvents map[string]float64
+	}{
+		{
+			name:       "changed",
+			report:     v4Report{Certname: "changed.example.com", Status: "changed", EndTime: "2019-01-02T03:04:05.000Z", Resources: events("success", "success", "noop")},
+			wantStatus: map[string]float64{"failed": 0, "changed": 1, "unchanged": 0},
+			wantEvents: map[string]float64{"failed": 0, "changed": 2, "noop": 1},
+		},
+		{
+			name:       "failed",
+			report:     v4Report{Certname: "failed.example.com", Status: "failed", EndTime: "2019-01-02T03:04:05.000Z", Resources: events("failure", "success")},
+			wantStatus: map[string]float64{"failed": 1, "changed": 0, "unchanged": 0},
+			wantEvents: map[string]float64{"failed": 1, "changed": 1, "noop": 0},
+		},
+		{
+			name:       "unknown status",
+			report:     v4Report{Certname: "unknown.example.com", EndTime: "2019-01-02T03:04:05.000Z"},
+			wantStatus: map[string]float64{"failed": 0, "changed": 0, "unchanged": 0},
+			wantEvents: map[string]float64{"failed": 0, "changed": 0, "noop": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, &config{NodeMetrics: nodeMetricsConfig{Enabled: true}})
+			n := newNodeRunMetrics()
+			n.observe(&tt.report)
+			defer n.forget(tt.report.Certname)
+
+			if got := gaugeValue(nodeLastRun, tt.report.Certname); got != 1546398245 {
+				t.Errorf("got last run %v", got)
+			}
+			for s, want := range tt.wantStatus {
+				if got := gaugeValue(nodeLastRunStatus, tt.report.Certname, s); got != want {
+					t.Errorf("got status %s %v, want %v", s, got, want)
+				}
+			}
+			for s, want := range tt.wantEvents {
+				if got := gaugeValue(nodeLastRunEvents, tt.report.Certname, s); got != want {
+					t.Errorf("got %s events %v, want %v", s, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNodeRunMetricsLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   nodeMetricsConfig
+		certname string
+		want     bool
+	}{
+		{
+			name:     "disabled",
+			config:   nodeMetricsConfig{},
+			certname: "web01.example.com",
+		},
+		{
+			name:     "certname allowed",
+			config:   nodeMetricsConfig{Enabled: true, Certnames: []string{"web*"}},
+			certname: "web01.example.com",
+			want:     true,
+		},
+		{
+			name:     "certname not allowed",
+			config:   nodeMetricsConfig{Enabled: true, Certnames: []string{"web*"}},
+			certname: "db01.example.com",
+		},
+		{
+			name:     "node limit reached",
+			config:   nodeMetricsConfig{Enabled: true, MaxNodes: 1},
+			certname: "web02.example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, &config{NodeMetrics: tt.config})
+			n := newNodeRunMetrics()
+			if tt.config.MaxNodes > 0 {
+				n.nodes["web01.example.com"] = "6.4.0"
+			}
+			n.observe(&v4Report{Certname: tt.certname, PuppetVersion: "6.4.0"})
+			if got := nodeLastRun.DeleteLabelValues(tt.certname); got != tt.want {
+				t.Errorf("got exported %v, want %v", got, tt.want)
+			}
+			n.forget(tt.certname)
+		})
+	}
+}
+
+func TestNodeRunMetricsForget(t *testing.T) {
+	setTestConfig(t, &config{NodeMetrics: nodeMetricsConfig{Enabled: true}})
+	n := newNodeRunMetrics()
+	n.observe(&v4Report{Certname: "web01.example.com", PuppetVersion: "6.4.0", Status: "changed"})
+	n.observe(&v4Report{Certname: "web01.example.com", PuppetVersion: "6.5.0", Status: "changed"})
+	if nodePuppetInfo.DeleteLabelValues("web01.example.com", "6.4.0") {
+		t.Error("series of the previous puppet version kept")
+	}
+
+	n.forget("web01.example.com")
+	if nodeLastRun.DeleteLabelValues("web01.example.com") || nodePuppetInfo.DeleteLabelValues("web01.example.com", "6.5.0") {
+		t.Error("series kept after forget")
+	}
+	if len(n.nodes) != 0 {
+		t.Errorf("got nodes %v", n.nodes)
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
 	"github.com/felixge/httpsnoop"
+	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -20,30 +23,129 @@ var (
 		[]string{"code", "method"},
 	)
 	// requestDuration collects sets of histograms for measure HTTP request latencies,
-	// partitioned by method, URI and status code.
+	// partitioned by method, route template (not the raw path, which holds
+	// certnames) and status code.
 	requestDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Name:    "puppetdb_proxy_http_reuests_duration_seconds",
+			Name:    "puppetdb_proxy_http_requests_duration_seconds",
 			Help:    "Time in seconds spent serving HTTP requests.",
 			Buckets: prometheus.DefBuckets,
 		},
 		[]string{"method", "uri", "status_code"},
 	)
+	// commandsTotal counts commands by command, received version and result
+	// (ok, convert_error or submit_error).
+	commandsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_commands_total",
+			Help: "How many commands processed, partitioned by command, version and result.",
+		},
+		[]string{"command", "version", "result"},
+	)
+	conversionDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "puppetdb_proxy_command_conversion_duration_seconds",
+			Help:    "Time in seconds spent converting commands from v3 to v4.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		},
+		[]string{"command"},
+	)
+	// payloadSize measures the JSON of command payloads as received from
+	// the Puppet master (stage v3) and as sent to PuppetDB (stage v4).
+	payloadSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "puppetdb_proxy_command_payload_size_bytes",
+			Help:    "Size in bytes of the JSON of command payloads, partitioned by command and stage (v3 or v4).",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+		},
+		[]string{"command", "stage"},
+	)
+	// reportStatusMismatches counts reports whose status sent by the agent
+	// differs from the one inferred from their events.
+	reportStatusMismatches = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_report_status_mismatches_total",
+			Help: "Reports whose status sent by the agent differs from the status of their events, partitioned by both statuses.",
+		},
+		[]string{"sent", "inferred"},
+	)
+	upstreamDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "puppetdb_proxy_upstream_request_duration_seconds",
+			Help:    "Time in seconds spent on requests to PuppetDB, partitioned by endpoint and status code.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"endpoint", "status_code"},
+	)
+	// lastSubmission is the time of the last command accepted by PuppetDB,
+	// or the start time until then.
+	lastSubmission     = time.Now()
+	lastSubmissionLock sync.Mutex
+	lastSubmissionAge  = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "puppetdb_proxy_last_successful_submission_age_seconds",
+			Help: "Time in seconds since the last command accepted by PuppetDB, or since start if none yet.",
+		},
+		func() float64 {
+			lastSubmissionLock.Lock()
+			defer lastSubmissionLock.Unlock()
+			return time.Since(lastSubmission).Seconds()
+		},
+	)
 )
 
 func init() {
 	// Register the collectors with Prometheus's default registry.
 	prometheus.MustRegister(httpReqs)
 	prometheus.MustRegister(requestDuration)
+	prometheus.MustRegister(commandsTotal)
+	prometheus.MustRegister(conversionDuration)
+	prometheus.MustRegister(payloadSize)
+	prometheus.MustRegister(reportStatusMismatches)
+	prometheus.MustRegister(upstreamDuration)
+	prometheus.MustRegister(lastSubmissionAge)
+}
+
+// commandLabel returns the command name for metric labels, so unknown
+// commands sent by clients don't create new series.
+func commandLabel(command string) string {
+	switch command {
+	case "replace facts", "replace catalog", "store report", "deactivate node", httpReportCommand:
+		return command
+	}
+	return "unknown"
+}
+
+func markSubmission() {
+	lastSubmissionLock.Lock()
+	lastSubmission = time.Now()
+	lastSubmissionLock.Unlock()
 }
 
 func (s *server) metricsMiddleware(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == streamRoute {
+			h.ServeHTTP(w, r)
+			return
+		}
 		m := httpsnoop.CaptureMetrics(h, w, r)
 		// Increase total counter.
 		httpReqs.WithLabelValues(strconv.Itoa(m.Code), r.Method).Inc()
 		// Measures histograms.
-		requestDuration.WithLabelValues(r.Method, r.URL.Path,
+		requestDuration.WithLabelValues(r.Method, routeTemplate(r),
 			strconv.Itoa(m.Code)).Observe(m.Duration.Seconds())
 	})
 }
+
+// routeTemplate returns the path template of the matched route, e.g. /v3/nodes/{name}.
+func routeTemplate(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unmatched"
+	}
+	tpl, err := route.GetPathTemplate()
+	if err != nil {
+		return "unmatched"
+	}
+	return tpl
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// histogramCount returns the number of observations of a histogram series.
+func histogramCount(h *prometheus.HistogramVec, labels ...string) uint64 {
+	var m dto.Metric
+	h.WithLabelValues(labels...).(prometheus.Histogram).Write(&m)
+	return m.GetHistogram().GetSampleCount()
+}
+
+// counterValue returns the value of a counter series.
+func counterValue(c *prometheus.CounterVec, labels ...string) float64 {
+	var m dto.Metric
+	c.WithLabelValues(labels...).Write(&m)
+	return m.GetCounter().GetValue()
+}
+
+func TestCommandLabel(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"replace facts", "replace facts"},
+		{"replace catalog", "replace catalog"},
+		{"store report", "store report"},
+		{"deactivate node", "deactivate node"},
+		{"replace facts; drop table", "unknown"},
+		{"", "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			if got := commandLabel(tt.command); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcessCommandMetrics(t *testing.T) {
+	tests := []struct {
+		name       string
+		command    v3Commands
+		status     int
+		wantLabel  string
+		wantResult string
+		wantV4     uint64
+	}{
+		{
+			name:       "submitted",
+			command:    v3Commands{Command: "deactivate node", Version: 2, Payload: []byte(`"web01.example.com"`)},
+			status:     http.StatusOK,
+			wantLabel:  "deactivate node",
+			wantResult: "ok",
+			wantV4:     1,
+		},
+		{
+			name:       "rejected by PuppetDB",
+			command:    v3Commands{Command: "deactivate node", Version: 2, Payload: []byte(`"web01.example.com"`)},
+			status:     http.StatusBadRequest,
+			wantLabel:  "deactivate node",
+			wantResult: "submit_error",
+			wantV4:     1,
+		},
+		{
+			name:       "unknown command",
+			command:    v3Commands{Command: "store inventory", Version: 1, Payload: []byte(`"web01.example.com"`)},
+			status:     http.StatusOK,
+			wantLabel:  "unknown",
+			wantResult: "convert_error",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pdb := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(`{"uuid":"5c9e6fa0-2d1b-4a8e-9c6a-0d1e2f3a4b5c"}`))
+			}))
+			defer pdb.Close()
+			setTestConfig(t, &config{PuppetDB: puppetDBConfig{URLs: []string{pdb.URL}}})
+
+			v3Before := histogramCount(payloadSize, tt.wantLabel, "v3")
+			v4Before := histogramCount(payloadSize, tt.wantLabel, "v4")
+			version := strconv.Itoa(tt.command.Version)
+			resultBefore := counterValue(commandsTotal, tt.wantLabel, version, tt.wantResult)
+
+			processCommand(tt.command)
+
+			if got := histogramCount(payloadSize, tt.wantLabel, "v3") - v3Before; got != 1 {
+				t.Errorf("got %d v3 payload observations, want 1", got)
+			}
+			if got := histogramCount(payloadSize, tt.wantLabel, "v4") - v4Before; got != tt.wantV4 {
+				t.Errorf("got %d v4 payload observations, want %d", got, tt.wantV4)
+			}
+			if got := counterValue(commandsTotal, tt.wantLabel, version, tt.wantResult) - resultBefore; got != 1 {
+				t.Errorf("got %v %s commands, want 1", got, tt.wantResult)
+			}
+		})
+	}
+}
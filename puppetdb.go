@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -302,21 +303,64 @@ func getEvents(vs url.Values) (v3Events, error) {
 		return v3Events{}, err
 	}
 
-	var e v3Events
-	err = json.Unmarshal(body, &e)
+	var a aliasEvents
+	err = json.Unmarshal(body, &a)
 	if err != nil {
 		return v3Events{}, err
 	}
 
+	var e = make(v3Events, len(a))
+	for i := range a {
+		e[i] = v3Event(a[i])
+		e[i].setContainingClass()
+	}
+
 	return e, nil
 }
 
+// doWithBackends sends the request made by newReq to each configured
+// PuppetDB URL in order, until one of them answers. The endpoint is only
+// used to label metrics.
+func doWithBackends(endpoint string, newReq func(base string) (*http.Request, error)) (*http.Response, error) {
+	c := conf()
+	var lastErr error
+	for _, base := range c.PuppetDB.URLs {
+		req, err := newReq(base)
+		if err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		resp, err := c.client.Do(req)
+		if err != nil {
+			upstreamDuration.WithLabelValues(endpoint, "error").Observe(time.Since(start).Seconds())
+			lastErr = err
+			continue
+		}
+		upstreamDuration.WithLabelValues(endpoint, strconv.Itoa(resp.StatusCode)).Observe(time.Since(start).Seconds())
+		return resp, nil
+	}
+
+	return nil, lastErr
+}
+
+// getRaw does a GET request of the PuppetDB URI without parameters.
+func getRaw(uri string) (*http.Response, error) {
+	return doWithBackends(strings.TrimPrefix(uri, "/pdb/"), func(base string) (*http.Request, error) {
+		return http.NewRequest(http.MethodGet, base+uri, nil)
+	})
+}
+
 func getWithData(vs url.Values, uri string) ([]byte, error) {
-	client := http.Client{}
-	data := ioutil.NopCloser(strings.NewReader(vs.Encode()))
-	req, err := http.NewRequest(http.MethodGet, opts.PuppetDBURL+"/pdb/query/v4/"+uri, data)
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-	resp, err := client.Do(req)
+	endpoint := "query/v4/" + strings.SplitN(uri, "/", 2)[0]
+	resp, err := doWithBackends(endpoint, func(base string) (*http.Request, error) {
+		data := ioutil.NopCloser(strings.NewReader(vs.Encode()))
+		req, err := http.NewRequest(http.MethodGet, base+"/pdb/query/v4/"+uri, data)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -330,20 +374,25 @@ func getWithData(vs url.Values, uri string) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	dumps.query(uri, vs, body)
 
 	return body, err
 }
 
 func postWithData(body []byte, values url.Values) ([]byte, error) {
-	req, err := http.NewRequest("POST", opts.PuppetDBURL+"/pdb/cmd/v1", bytes.NewBuffer(body))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
-
 	// Add URL query params
-	req.URL.RawQuery = valuesToString(values)
+	query := valuesToString(values)
 
-	client := http.Client{}
-	resp, err := client.Do(req)
+	resp, err := doWithBackends("cmd/v1", func(base string) (*http.Request, error) {
+		req, err := http.NewRequest("POST", base+"/pdb/cmd/v1", bytes.NewBuffer(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+		req.URL.RawQuery = query
+		return req, nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -353,6 +402,9 @@ func postWithData(body []byte, values url.Values) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("PuppetDB returned %s: %s", resp.Status, strings.TrimSpace(string(b)))
+	}
 
 	return b, nil
 }
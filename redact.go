@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Replacements of redacted values.
+const (
+	redactMarker = "marker"
+	redactHash   = "hash"
+)
+
+// redactedPrefix starts every redacted value, values starting with it are
+// not redacted again, e.g. when a dead-lettered command is retried.
+const redactedPrefix = "[REDACTED"
+
+var redactionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "puppetdb_proxy_redactions_total",
+		Help: "Catalog parameters and facts redacted, partitioned by rule.",
+	},
+	[]string{"rule"},
+)
+
+func init() {
+	prometheus.MustRegister(redactionsTotal)
+}
+
+// redactionRule replaces the values of the catalog parameters matching the
+// resource type glob (any if empty) and the parameter name regexp, or of the
+// facts matching the fact path, a dot separated path of globs like
+// ec2_metadata.iam.*. Matching a structured fact redacts all of it.
+type redactionRule struct {
+	Name         string `yaml:"name" json:"name"`
+	ResourceType string `yaml:"resource_type" json:"resource_type,omitempty"`
+	Parameter    string `yaml:"parameter" json:"parameter,omitempty"`
+	Fact         string `yaml:"fact" json:"fact,omitempty"`
+	// Replace is marker or hash, hashes let changes of the value show.
+	Replace string `yaml:"replace" json:"replace"`
+}
+
+// redaction is a validated redaction rule.
+type redaction struct {
+	redactionRule
+	parameter *regexp.Regexp
+	fact      []string
+}
+
+// init validates the rule and sets its defaults, i is its index.
+func (r *redactionRule) init(i int) (redaction, error) {
+	if r.Name == "" {
+		r.Name = fmt.Sprintf("rule%d", i+1)
+	}
+	if r.Replace == "" {
+		r.Replace = redactMarker
+	}
+	if r.Replace != redactMarker && r.Replace != redactHash {
+		return redaction{}, fmt.Errorf("redaction rule %s: invalid replace %q, want marker or hash", r.Name, r.Replace)
+	}
+	if (r.Parameter == "") == (r.Fact == "") {
+		return redaction{}, fmt.Errorf("redaction rule %s: set either parameter or fact", r.Name)
+	}
+	if r.Fact != "" && r.ResourceType != "" {
+		return redaction{}, fmt.Errorf("redaction rule %s: resource_type applies to parameters only", r.Name)
+	}
+
+	rd := redaction{redactionRule: *r}
+	if r.Parameter != "" {
+		re, err := regexp.Compile(r.Parameter)
+		if err != nil {
+			return redaction{}, fmt.Errorf("redaction rule %s: %v", r.Name, err)
+		}
+		rd.parameter = re
+	}
+	if r.ResourceType != "" {
+		if err := checkPattern(r.ResourceType); err != nil {
+			return redaction{}, fmt.Errorf("redaction rule %s: %v", r.Name, err)
+		}
+	}
+	if r.Fact != "" {
+		rd.fact = strings.Split(r.Fact, ".")
+		for _, p := range rd.fact {
+			if err := checkPattern(p); err != nil {
+				return redaction{}, fmt.Errorf("redaction rule %s: %v", r.Name, err)
+			}
+		}
+	}
+	return rd, nil
+}
+
+func (r redaction) matchParameter(resourceType, name string) bool {
+	if r.parameter == nil {
+		return false
+	}
+	if r.ResourceType != "" {
+		if ok, _ := path.Match(strings.ToLower(r.ResourceType), strings.ToLower(resourceType)); !ok {
+			return false
+		}
+	}
+	return r.parameter.MatchString(name)
+}
+
+func (r redaction) matchFact(factPath []string) bool {
+	if len(r.fact) != len(factPath) {
+		return false
+	}
+	for i, p := range r.fact {
+		if ok, _ := path.Match(p, factPath[i]); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// replace returns the redacted value.
+func (r redaction) replace(v json.RawMessage) json.RawMessage {
+	marker := redactedPrefix + "]"
+	if r.Replace == redactHash {
+		sum := sha256.Sum256(v)
+		marker = redactedPrefix + " sha256:" + hex.EncodeToString(sum[:]) + "]"
+	}
+	j, _ := json.Marshal(marker)
+	return j
+}
+
+// redactCommand redacts the payload of a replace catalog or replace facts
+// command in place, and reports whether anything was redacted. Redactions
+// are counted if count is set. Payloads that can't be decoded are left
+// alone, their conversion fails anyway.
+func redactCommand(v3c *v3Commands, count bool) bool {
+	rules := conf().redactions
+	if len(rules) == 0 {
+		return false
+	}
+	var payload json.RawMessage
+	var n map[string]int
+	switch v3c.Command {
+	case "replace catalog":
+		payload, n = redactCatalog(v3c.Payload, rules)
+	case "replace facts":
+		payload, n = redactFacts(v3c.Payload, rules)
+	}
+	if len(n) == 0 {
+		return false
+	}
+	v3c.Payload = payload
+	if count {
+		for rule, c := range n {
+			redactionsTotal.WithLabelValues(rule).Add(float64(c))
+		}
+	}
+	return true
+}
+
+// redactCatalog redacts the resource parameters, keeping the other fields
+// of the payload as they are.
+func redactCatalog(payload json.RawMessage, rules []redaction) (json.RawMessage, map[string]int) {
+	var catalog map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &catalog); err != nil {
+		return payload, nil
+	}
+	var resources []map[string]json.RawMessage
+	if err := json.Unmarshal(catalog["resources"], &resources); err != nil {
+		return payload, nil
+	}
+
+	n := make(map[string]int)
+	for _, res := range resources {
+		var resourceType string
+		json.Unmarshal(res["type"], &resourceType)
+		var params map[string]json.RawMessage
+		if err := json.Unmarshal(res["parameters"], &params); err != nil {
+			continue
+		}
+		var changed bool
+		for name, v := range params {
+			if isRedacted(v) {
+				continue
+			}
+			for _, r := range rules {
+				if r.matchParameter(resourceType, name) {
+					params[name] = r.replace(v)
+					n[r.Name]++
+					changed = true
+					break
+				}
+			}
+		}
+		if changed {
+			res["parameters"], _ = json.Marshal(params)
+		}
+	}
+	if len(n) == 0 {
+		return payload, nil
+	}
+	catalog["resources"], _ = json.Marshal(resources)
+	j, err := json.Marshal(catalog)
+	if err != nil {
+		return payload, nil
+	}
+	return j, n
+}
+
+// redactFacts redacts the facts matching the fact rules, walking down
+// structured facts, including the ones Facter 1.x and 2.x send as JSON
+// strings, which the fact rules may decode later.
+func redactFacts(payload json.RawMessage, rules []redaction) (json.RawMessage, map[string]int) {
+	var facts map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &facts); err != nil {
+		return payload, nil
+	}
+	n := make(map[string]int)
+	values, ok := redactFactValues(facts["values"], nil, rules, n)
+	if !ok || len(n) == 0 {
+		return payload, nil
+	}
+	facts["values"] = values
+	j, err := json.Marshal(facts)
+	if err != nil {
+		return payload, nil
+	}
+	return j, n
+}
+
+func redactFactValues(v json.RawMessage, factPath []string, rules []redaction, n map[string]int) (json.RawMessage, bool) {
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(v, &values); err != nil {
+		return v, false
+	}
+	var changed bool
+	for name, value := range values {
+		p := append(factPath[:len(factPath):len(factPath)], name)
+		var matched bool
+		for _, r := range rules {
+			if r.matchFact(p) {
+				matched = true
+				if !isRedacted(value) {
+					values[name] = r.replace(value)
+					n[r.Name]++
+					changed = true
+				}
+				break
+			}
+		}
+		if matched {
+			continue
+		}
+		nested, stringified := stringifiedObject(value)
+		if !stringified && !bytes.HasPrefix(bytes.TrimSpace(value), []byte("{")) {
+			continue
+		}
+		if !stringified {
+			nested = value
+		}
+		if redacted, ok := redactFactValues(nested, p, rules, n); ok {
+			// A stringified fact stays a string, with the values redacted.
+			if stringified {
+				redacted, _ = json.Marshal(string(redacted))
+			}
+			values[name] = redacted
+			changed = true
+		}
+	}
+	if !changed {
+		return v, false
+	}
+	j, err := json.Marshal(values)
+	if err != nil {
+		return v, false
+	}
+	return j, true
+}
+
+// stringifiedObject returns the JSON object held by a string value.
+func stringifiedObject(v json.RawMessage) (json.RawMessage, bool) {
+	var s string
+	if json.Unmarshal(v, &s) != nil {
+		return nil, false
+	}
+	b := bytes.TrimSpace([]byte(s))
+	if !bytes.HasPrefix(b, []byte("{")) || !json.Valid(b) {
+		return nil, false
+	}
+	return b, true
+}
+
+func isRedacted(v json.RawMessage) bool {
+	var s string
+	return json.Unmarshal(v, &s) == nil && strings.HasPrefix(s, redactedPrefix)
+}
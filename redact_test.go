@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestRedactFactValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		fact  string
+		facts string
+		want  string
+		n     int
+	}{
+		{
+			name:  "top level fact",
+			fact:  "root_password",
+			facts: `{"root_password":"s3cret","os":"CentOS"}`,
+			want:  `{"root_password":"[REDACTED]","os":"CentOS"}`,
+			n:     1,
+		},
+		{
+			name:  "nested glob",
+			fact:  "ec2_metadata.iam.*",
+			facts: `{"ec2_metadata":{"iam":{"info":"x","security-credentials":{"key":"k"}},"ami-id":"ami-1"}}`,
+			want:  `{"ec2_metadata":{"iam":{"info":"[REDACTED]","security-credentials":"[REDACTED]"},"ami-id":"ami-1"}}`,
+			n:     2,
+		},
+		{
+			name:  "structured fact redacted as a whole",
+			fact:  "ec2_metadata",
+			facts: `{"ec2_metadata":{"iam":{"info":"x"}}}`,
+			want:  `{"ec2_metadata":"[REDACTED]"}`,
+			n:     1,
+		},
+		{
+			name:  "path deeper than the fact",
+			fact:  "os.release.major",
+			facts: `{"os":"CentOS"}`,
+			want:  `{"os":"CentOS"}`,
+		},
+		{
+			name:  "already redacted",
+			fact:  "root_password",
+			facts: `{"root_password":"[REDACTED]"}`,
+			want:  `{"root_password":"[REDACTED]"}`,
+		},
+		{
+			name:  "stringified structured fact",
+			fact:  "ec2_metadata.iam.*",
+			facts: `{"ec2_metadata":"{\"iam\":{\"info\":\"x\"},\"ami-id\":\"ami-1\"}"}`,
+			want:  `{"ec2_metadata":"{\"ami-id\":\"ami-1\",\"iam\":{\"info\":\"[REDACTED]\"}}"}`,
+			n:     1,
+		},
+		{
+			name:  "glob on names",
+			fact:  "*_token",
+			facts: `{"vault_token":"t","token":"u"}`,
+			want:  `{"vault_token":"[REDACTED]","token":"u"}`,
+			n:     1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := (&redactionRule{Name: "test", Fact: tt.fact}).init(0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n := make(map[string]int)
+			got, _ := redactFactValues(json.RawMessage(tt.facts), nil, []redaction{r}, n)
+			var gotValues, wantValues interface{}
+			json.Unmarshal(got, &gotValues)
+			json.Unmarshal([]byte(tt.want), &wantValues)
+			if !reflect.DeepEqual(gotValues, wantValues) {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if n["test"] != tt.n {
+				t.Errorf("got %d redactions, want %d", n["test"], tt.n)
+			}
+		})
+	}
+}
+
+func TestRedactionHashMarker(t *testing.T) {
+	r, err := (&redactionRule{Name: "test", Parameter: "^password$", Replace: redactHash}).init(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := r.replace(json.RawMessage(`"one"`)), r.replace(json.RawMessage(`"two"`))
+	if string(a) == string(b) {
+		t.Errorf("different values give the same marker %s", a)
+	}
+	if !isRedacted(a) {
+		t.Errorf("marker %s is not recognized as redacted", a)
+	}
+	if !r.matchParameter("User", "password") || r.matchParameter("User", "password_max_age") {
+		t.Error("parameter regexp mismatch")
+	}
+}
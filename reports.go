@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"sort"
+	"strings"
 	"time"
-
-	"github.com/google/uuid"
 )
 
 type v3Report struct {
@@ -165,72 +165,257 @@ type v4ReportsGet []v4ReportGet
 func v3toV4ReportConv(v3r v3Report) v4Report {
 	var v4r v4Report
 	v4r.Certname = v3r.Certname
-	v4r.Environment = opts.Environment
-	v4r.Status = v3r.Status
+	v4r.Environment, v4r.Producer = conf().rewrite(v3r.Certname)
 	v4r.PuppetVersion = v3r.PuppetVersion
 	v4r.ReportFormat = 8
 	v4r.ProducerTimestamp = time.Now().Format(time.RFC3339)
-	v4r.Producer = opts.Producer
 	v4r.ConfigurationVersion = v3r.ConfigurationVersion
 	v4r.StartTime = v3r.StartTime
 	v4r.EndTime = v3r.EndTime
-	v4r.CatalogUUID = uuid.New().String()
-	v4r.CachedCatalogStatus = "not_used"
+	v4r.CatalogUUID, v4r.CachedCatalogStatus = catalogIDs.report(v3r.Certname, v3r.TransactionUUID)
 	v4r.TransactionUUID = v3r.TransactionUUID
 	v4r.CorrectiveChange = false
-	// Fake log
-	var v4l v4Log
-	v4l.Level = "notice"
-	v4l.Tags = append(v4l.Tags, "notice")
-	v4l.Source = "Puppet"
-	v4l.Time = time.Now().Format(time.RFC3339)
-	v4l.Message = "Puppet agent v3 does not send messages"
-	v4r.Logs = append(v4r.Logs, v4l)
-
-	var eventsStatus = make(map[string]float64)
+	v4r.Resources = v4Resources{}
+	v4r.Logs = v4Logs{}
 
+	// Events of the same resource are reported one by one.
+	var index = make(map[string]int)
 	for _, v3res := range v3r.ResourceEvents {
-		var v4res v4Resource
-		v4res.ResourceType = v3res.ResourceType
-		v4res.ResourceTitle = v3res.ResourceTitle
-		v4res.TimeStamp = v3res.TimeStamp
-		v4res.File = v3res.File
-		v4res.Line = v3res.Line
-		v4res.ContainmentPath = v3res.ContainmentPath
-		v4res.CorrectiveChange = false
+		key := v3res.ResourceType + "[" + v3res.ResourceTitle + "]"
+		i, ok := index[key]
+		if !ok {
+			var v4res v4Resource
+			v4res.ResourceType = v3res.ResourceType
+			v4res.ResourceTitle = v3res.ResourceTitle
+			v4res.TimeStamp = v3res.TimeStamp
+			v4res.File = v3res.File
+			v4res.Line = v3res.Line
+			v4res.ContainmentPath = v3res.ContainmentPath
+			v4res.CorrectiveChange = false
+			i = len(v4r.Resources)
+			index[key] = i
+			v4r.Resources = append(v4r.Resources, v4res)
+		}
 
 		var v4ree v4ResourceEventExpanded
 		v4ree.Status = v3res.Status
-		eventsStatus[v3res.Status]++
-		eventsStatus["total"]++
 		v4ree.TimeStamp = v3res.TimeStamp
+		v4ree.ResourceType = v3res.ResourceType
+		v4ree.ResourceTitle = v3res.ResourceTitle
 		v4ree.NewValue = v3res.NewValue
 		v4ree.OldValue = v3res.OldValue
 		v4ree.Message = v3res.Message
+		v4ree.File = v3res.File
+		v4ree.Line = v3res.Line
+		v4ree.ContainmentPath = v3res.ContainmentPath
 		v4ree.CorrectiveChange = false
 		v4ree.Property = v3res.Property
-		v4res.Events = append(v4res.Events, v4ree)
+		v4r.Resources[i].Events = append(v4r.Resources[i].Events, v4ree)
+		// Puppet sends a skipped event for resources it didn't apply,
+		// e.g. because a dependency failed.
+		if v3res.Status == "skipped" {
+			v4r.Resources[i].Skipped = true
+		}
 
-		v4r.Resources = append(v4r.Resources, v4res)
+		v4r.Logs = append(v4r.Logs, eventLog(v3res))
 	}
 
-	for k, v := range eventsStatus {
-		var v4m v4Metric
-		v4m.Category = "events"
-		v4m.Name = k
-		v4m.Value = v
-		v4r.Metrics = append(v4r.Metrics, v4m)
-	}
+	inferRunStatus(&v4r, v3r.Status)
+	lastCatalogs.complete(&v4r)
+	v4r.Metrics = reportMetrics(&v4r)
 
 	return v4r
 }
 
+// inferRunStatus sets the status, noop and noop_pending of the report from
+// its events: failed if an event failed, changed if one succeeded,
+// unchanged otherwise. Noop events make the run noop_pending, and noop when
+// nothing was changed. The status the agent sent wins when it is worse,
+// e.g. a run failing before the catalog was applied has no failed events.
+func inferRunStatus(r *v4Report, sent string) {
+	status := "unchanged"
+	var changed, noop bool
+	for _, res := range r.Resources {
+		for _, e := range res.Events {
+			switch e.Status {
+			case "failure":
+				status = "failed"
+			case "success":
+				changed = true
+			case "noop":
+				noop = true
+			}
+		}
+	}
+	if changed && status != "failed" {
+		status = "changed"
+	}
+	r.NoopPending = noop
+	r.Noop = noop && !changed
+
+	r.Status = status
+	if sent == "" || sent == status {
+		return
+	}
+	label := sent
+	if !contains(runStatuses, sent) {
+		label = "unknown"
+	}
+	reportStatusMismatches.WithLabelValues(label, status).Inc()
+	traces.tracef(r.Certname, "report status %s sent by the agent differs from status %s of the events", sent, status)
+	if statusRank(sent) > statusRank(status) {
+		r.Status = sent
+	}
+}
+
+// statusRank orders the run statuses by severity, unknown ones lowest.
+func statusRank(status string) int {
+	for i, s := range runStatuses {
+		if s == status {
+			return len(runStatuses) - i
+		}
+	}
+	return 0
+}
+
+// eventLog synthesizes the log Puppet writes for a resource event.
+func eventLog(e v3ResourceEvent) v4Log {
+	var l v4Log
+	l.File = e.File
+	l.Line = e.Line
+	l.Level = "notice"
+	if e.Status == "failure" {
+		l.Level = "err"
+	}
+	l.Message = e.Message
+	l.Source = eventSource(e.ResourceType, e.ResourceTitle, e.ContainmentPath, e.Property)
+	l.Tags = eventTags(l.Level, e.ResourceType, e.ContainmentPath)
+	l.Time = e.TimeStamp
+
+	return l
+}
+
+// eventSource returns the log source the way Puppet names it,
+// e.g. /Stage[main]/Main/File[/etc/motd]/content.
+func eventSource(resourceType, title string, containmentPath []string, property string) string {
+	source := resourceType + "[" + title + "]"
+	if len(containmentPath) > 0 {
+		source = strings.Join(containmentPath, "/")
+	}
+	if property != "" {
+		source += "/" + property
+	}
+	return "/" + source
+}
+
+// eventTags returns the tags Puppet gives the log of a resource event: its
+// level, the resource type and the classes containing the resource.
+func eventTags(level, resourceType string, containmentPath []string) []string {
+	var tags = []string{level, strings.ToLower(resourceType)}
+	for _, c := range containmentPath {
+		if strings.Contains(c, "[") {
+			continue
+		}
+		tag := strings.ToLower(c)
+		if !contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(containmentPath) > 1 {
+		tags = append(tags, "class")
+	}
+
+	return tags
+}
+
+// reportCounts counts the events of the report by status and its resources
+// by outcome.
+func reportCounts(r *v4Report) (events, resources map[string]float64) {
+	events = map[string]float64{"total": 0, "success": 0, "failure": 0, "noop": 0}
+	resources = map[string]float64{"total": 0, "changed": 0, "failed": 0, "skipped": 0, "out_of_sync": 0}
+	for _, res := range r.Resources {
+		resources["total"]++
+		var changed, failed, outOfSync, skipped bool
+		skipped = res.Skipped
+		for _, e := range res.Events {
+			// Puppet counts the skipped resources, not their events.
+			if e.Status == "skipped" {
+				skipped = true
+				continue
+			}
+			events["total"]++
+			events[e.Status]++
+			switch e.Status {
+			case "success":
+				changed, outOfSync = true, true
+			case "failure":
+				failed, outOfSync = true, true
+			case "noop":
+				outOfSync = true
+			}
+		}
+		if changed {
+			resources["changed"]++
+		}
+		if failed {
+			resources["failed"]++
+		}
+		if skipped {
+			resources["skipped"]++
+		}
+		if outOfSync {
+			resources["out_of_sync"]++
+		}
+	}
+
+	return events, resources
+}
+
+// reportMetrics returns the events, resources and time metrics of the report.
+func reportMetrics(r *v4Report) v4Metrics {
+	var metrics = v4Metrics{}
+	events, resources := reportCounts(r)
+	for _, m := range []struct {
+		category string
+		values   map[string]float64
+	}{
+		{"events", events},
+		{"resources", resources},
+		{"time", map[string]float64{"total": runDuration(r)}},
+	} {
+		var names []string
+		for name := range m.values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			metrics = append(metrics, v4Metric{Category: m.category, Name: name, Value: m.values[name]})
+		}
+	}
+
+	return metrics
+}
+
+// runDuration returns the run time in seconds from the start and end time
+// of the report, 0 if they are missing.
+func runDuration(r *v4Report) float64 {
+	start, err := time.Parse(time.RFC3339Nano, r.StartTime)
+	if err != nil {
+		return 0
+	}
+	end, err := time.Parse(time.RFC3339Nano, r.EndTime)
+	if err != nil || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start).Seconds()
+}
+
 func v4toV3ReportsConv(v4rs v4ReportsGet) v3Reports {
 	var v3rs v3Reports
 	for _, v4r := range v4rs {
 		var v3r v3Report
 		v3r.Certname = v4r.Certname
-		v3r.Environment = opts.Environment
+		v3r.Environment = conf().Environment
 		v3r.Hash = v4r.Hash
 		v3r.Status = v4r.Status
 		v3r.PuppetVersion = v4r.PuppetVersion
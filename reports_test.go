@@ -0,0 +1,143 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testReport returns a report with one resource per list of event statuses.
+func testReport(resources ...[]string) *v4Report {
+	r := &v4Report{Certname: "web01.example.com"}
+	for _, statuses := range resources {
+		res := v4Resource{ResourceType: "File", Events: []v4ResourceEventExpanded{}}
+		for _, s := range statuses {
+			res.Events = append(res.Events, v4ResourceEventExpanded{Status: s})
+		}
+		r.Resources = append(r.Resources, res)
+	}
+	return r
+}
+
+func TestReportCounts(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources [][]string
+		skipped   bool
+		events    map[string]float64
+		counts    map[string]float64
+	}{
+		{
+			name:   "empty",
+			events: map[string]float64{"total": 0, "success": 0, "failure": 0, "noop": 0},
+			counts: map[string]float64{"total": 0, "changed": 0, "failed": 0, "skipped": 0, "out_of_sync": 0},
+		},
+		{
+			name:      "mixed",
+			resources: [][]string{{"success", "success"}, {"failure"}, {"noop"}, {}, {"skipped"}},
+			events:    map[string]float64{"total": 4, "success": 2, "failure": 1, "noop": 1},
+			counts:    map[string]float64{"total": 5, "changed": 1, "failed": 1, "skipped": 1, "out_of_sync": 3},
+		},
+		{
+			name:      "skipped resource without events",
+			resources: [][]string{{}},
+			skipped:   true,
+			events:    map[string]float64{"total": 0, "success": 0, "failure": 0, "noop": 0},
+			counts:    map[string]float64{"total": 1, "changed": 0, "failed": 0, "skipped": 1, "out_of_sync": 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testReport(tt.resources...)
+			for i := range r.Resources {
+				r.Resources[i].Skipped = tt.skipped
+			}
+			events, resources := reportCounts(r)
+			if !reflect.DeepEqual(events, tt.events) {
+				t.Errorf("got events %v, want %v", events, tt.events)
+			}
+			if !reflect.DeepEqual(resources, tt.counts) {
+				t.Errorf("got resources %v, want %v", resources, tt.counts)
+			}
+		})
+	}
+}
+
+func TestInferRunStatus(t *testing.T) {
+	tests := []struct {
+		name        string
+		resources   [][]string
+		sent        string
+		status      string
+		noop        bool
+		noopPending bool
+	}{
+		{"no resources", nil, "", "unchanged", false, false},
+		{"unchanged resources", [][]string{{}, {}}, "unchanged", "unchanged", false, false},
+		{"success", [][]string{{"success"}, {}}, "changed", "changed", false, false},
+		{"failure wins", [][]string{{"success"}, {"failure"}}, "", "failed", false, false},
+		{"noop only", [][]string{{"noop"}, {"noop"}}, "unchanged", "unchanged", true, true},
+		{"noop and changes", [][]string{{"noop"}, {"success"}}, "", "changed", false, true},
+		{"skipped", [][]string{{"skipped"}}, "", "unchanged", false, false},
+		{"worse sent status wins", [][]string{{}}, "failed", "failed", false, false},
+		{"better sent status loses", [][]string{{"failure"}}, "changed", "failed", false, false},
+		{"unknown sent status", [][]string{{"success"}}, "weird", "changed", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testReport(tt.resources...)
+			inferRunStatus(r, tt.sent)
+			if r.Status != tt.status || r.Noop != tt.noop || r.NoopPending != tt.noopPending {
+				t.Errorf("got status %s noop %v noop_pending %v, want %s %v %v",
+					r.Status, r.Noop, r.NoopPending, tt.status, tt.noop, tt.noopPending)
+			}
+		})
+	}
+}
+
+func TestV3toV4ReportConvEvents(t *testing.T) {
+	setTestConfig(t, &config{})
+	path := []string{"Stage[main]", "Motd", "File[/etc/motd]"}
+	v3r := v3Report{
+		Certname:        "web01.example.com",
+		TransactionUUID: "tx-1",
+		ResourceEvents: v3ResourceEvents{
+			{ResourceType: "File", ResourceTitle: "/etc/motd", Property: "content", Status: "success", File: "/etc/puppet/modules/motd/manifests/init.pp", Line: 3, ContainmentPath: path},
+			{ResourceType: "File", ResourceTitle: "/etc/motd", Property: "mode", Status: "success", File: "/etc/puppet/modules/motd/manifests/init.pp", Line: 3, ContainmentPath: path},
+			{ResourceType: "Service", ResourceTitle: "ntpd", Status: "skipped"},
+		},
+	}
+	v4r := v3toV4ReportConv(v3r)
+
+	tests := []struct {
+		resource    string
+		wantEvents  int
+		wantFile    string
+		wantLine    int
+		wantPath    []string
+		wantSkipped bool
+	}{
+		{"File[/etc/motd]", 2, "/etc/puppet/modules/motd/manifests/init.pp", 3, path, false},
+		{"Service[ntpd]", 1, "", 0, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.resource, func(t *testing.T) {
+			var res *v4Resource
+			for i := range v4r.Resources {
+				if r := &v4r.Resources[i]; r.ResourceType+"["+r.ResourceTitle+"]" == tt.resource {
+					res = r
+				}
+			}
+			if res == nil {
+				t.Fatalf("resource not in %+v", v4r.Resources)
+			}
+			if res.Skipped != tt.wantSkipped || len(res.Events) != tt.wantEvents {
+				t.Fatalf("got skipped %v with %d events", res.Skipped, len(res.Events))
+			}
+			for _, e := range res.Events {
+				if e.ResourceType+"["+e.ResourceTitle+"]" != tt.resource || e.File != tt.wantFile || e.Line != tt.wantLine || !reflect.DeepEqual(e.ContainmentPath, tt.wantPath) {
+					t.Errorf("got event %s[%s] at %s:%d in %v", e.ResourceType, e.ResourceTitle, e.File, e.Line, e.ContainmentPath)
+				}
+			}
+		})
+	}
+}
@@ -2,31 +2,188 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
 )
 
 type server struct {
-	Router *mux.Router
-	Log    *log.Logger
+	Router     *mux.Router
+	Admin      *mux.Router
+	HTTP       *http.Server
+	AdminHTTP  *http.Server
+	Log        *log.Logger
+	DeadLetter *deadLetter
+	Health     *healthChecker
+
+	shutdownHooks []shutdownHook
 }
 
 func newServer() *server {
 	s := new(server)
 
+	s.initLogger()
+	s.initDeadLetter()
+	s.initDumper()
+	nodeRuns = newNodeRunMetrics()
+	catalogHistory = newCatalogTracker()
+	lastCatalogs = newLastCatalogStore()
+	catalogCheck = &catalogValidator{log: s.Log}
+	catalogSizes = newCatalogStripper(s.Log)
+	s.initCatalogIDs()
+	streams = newStreamBroker()
+	alerts = newAlerter(s.Log)
+	s.onShutdown("alerts", alerts.close)
+	s.initSinks()
+	s.Health = newHealthChecker()
+
 	s.Router = mux.NewRouter()
+	s.Router.Use(s.checkACL)
 	s.Router.Use(s.logHTTP)
 	s.Router.Use(s.metricsMiddleware)
 	s.initRoutes()
 
-	s.initLogger()
+	s.Admin = mux.NewRouter()
+	s.initAdminRoutes()
 
 	return s
 }
 
+func (s *server) initDeadLetter() {
+	if conf().DeadLetterDir == "" {
+		return
+	}
+	d, err := newDeadLetter(conf().DeadLetterDir)
+	if err != nil {
+		s.Log.Fatalf("failed to create dead letter directory: %v", err)
+	}
+	s.DeadLetter = d
+}
+
 func (s *server) run(addr string) {
-	s.Log.Infof("Run server on a %s", addr)
-	s.Log.Fatal(http.ListenAndServe(addr, s.Router))
+	c := conf()
+	done := make(chan struct{})
+	go s.handleSignals(done)
+
+	errc := make(chan error, 2)
+	if c.Admin.Address != "" {
+		s.AdminHTTP = s.newHTTPServer(c.Admin.Address, s.Admin)
+		go func() {
+			s.Log.Infof("Run admin API on a %s", c.Admin.Address)
+			errc <- s.AdminHTTP.ListenAndServe()
+		}()
+	}
+
+	s.HTTP = s.newHTTPServer(addr, s.Router)
+	s.HTTP.RegisterOnShutdown(streams.close)
+	go func() {
+		s.Log.Infof("Run server on a %s", addr)
+		errc <- s.HTTP.ListenAndServe()
+	}()
+
+	if err := <-errc; err != http.ErrServerClosed {
+		s.Log.Fatal(err)
+	}
+	<-done
+}
+
+func (s *server) newHTTPServer(addr string, handler http.Handler) *http.Server {
+	c := conf()
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  c.Server.ReadTimeout,
+		WriteTimeout: c.Server.WriteTimeout,
+		IdleTimeout:  c.Server.IdleTimeout,
+	}
+}
+
+// handleSignals reloads the config on SIGHUP and shuts the server down
+// on SIGINT or SIGTERM, closing done when finished.
+func (s *server) handleSignals(done chan struct{}) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			s.Log.Info("SIGHUP received, reloading config")
+			s.reload()
+			continue
+		}
+		s.Log.Infof("%s received, shutting down", sig)
+		signal.Stop(sigs)
+		s.shutdown()
+		close(done)
+		return
+	}
+}
+
+// onShutdown registers a function that flushes pending work on shutdown,
+// after the listeners are closed and in-flight requests are drained.
+// Functions are called in reverse order of registration.
+func (s *server) onShutdown(name string, fn func(ctx context.Context) error) {
+	s.shutdownHooks = append(s.shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// shutdown stops accepting connections, waits for in-flight requests and
+// then runs the shutdown hooks, all within the configured deadline.
+func (s *server) shutdown() {
+	timeout := conf().Server.ShutdownTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	s.Log.Infof("Draining connections for up to %s", timeout)
+	var wg sync.WaitGroup
+	for _, srv := range []*http.Server{s.HTTP, s.AdminHTTP} {
+		if srv == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				s.Log.Errorf("failed to drain connections on %s: %v", srv.Addr, err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	for i := len(s.shutdownHooks) - 1; i >= 0; i-- {
+		h := s.shutdownHooks[i]
+		if err := h.fn(ctx); err != nil {
+			s.Log.Errorf("failed to flush %s on shutdown: %v", h.name, err)
+		}
+	}
+}
+
+func (s *server) initCatalogIDs() {
+	m, err := newCatalogUUIDs(conf().CatalogUUIDs.File, s.Log)
+	if err != nil {
+		s.Log.Fatalf("failed to load catalog UUIDs: %v", err)
+	}
+	catalogIDs = m
+	s.onShutdown("catalog uuids", catalogIDs.close)
+}
+
+func (s *server) initSinks() {
+	set, err := newSinkSet(conf().Sinks, s.Log)
+	if err != nil {
+		s.Log.Fatal(err)
+	}
+	sinks = set
+	s.onShutdown("sinks", sinks.close)
+}
+
+func (s *server) initDumper() {
+	dumps = newDumper(conf().Dump)
 }
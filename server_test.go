@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestNewHTTPServer(t *testing.T) {
+	setTestConfig(t, &config{Server: serverConfig{ReadTimeout: time.Second, WriteTimeout: 2 * time.Second, IdleTimeout: 3 * time.Second}})
+	s := new(server)
+	srv := s.newHTTPServer("127.0.0.1:8088", http.NotFoundHandler())
+	if srv.ReadTimeout != time.Second || srv.WriteTimeout != 2*time.Second || srv.IdleTimeout != 3*time.Second {
+		t.Errorf("got timeouts %s, %s, %s", srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name       string
+		delay      time.Duration
+		timeout    time.Duration
+		wantStatus int
+	}{
+		{
+			name:       "in-flight request drained",
+			delay:      100 * time.Millisecond,
+			timeout:    5 * time.Second,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:    "deadline exceeded",
+			delay:   2 * time.Second,
+			timeout: 100 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setTestConfig(t, &config{Server: serverConfig{ShutdownTimeout: tt.timeout}})
+			s := new(server)
+			s.Log = log.New()
+			s.Log.Out = ioutil.Discard
+
+			started := make(chan struct{})
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				time.Sleep(tt.delay)
+				w.WriteHeader(http.StatusOK)
+			})
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.HTTP = s.newHTTPServer(ln.Addr().String(), handler)
+			go s.HTTP.Serve(ln)
+
+			var hooks []string
+			s.onShutdown("first", func(ctx context.Context) error {
+				hooks = append(hooks, "first")
+				return nil
+			})
+			s.onShutdown("second", func(ctx context.Context) error {
+				hooks = append(hooks, "second")
+				return ctx.Err()
+			})
+
+			status := make(chan int, 1)
+			go func() {
+				resp, err := http.Get("http://" + ln.Addr().String())
+				if err != nil {
+					status <- 0
+					return
+				}
+				resp.Body.Close()
+				status <- resp.StatusCode
+			}()
+			<-started
+			s.shutdown()
+
+			if !reflect.DeepEqual(hooks, []string{"second", "first"}) {
+				t.Errorf("got hooks %v, want them in reverse order", hooks)
+			}
+			if tt.wantStatus == 0 {
+				return
+			}
+			select {
+			case got := <-status:
+				if got != tt.wantStatus {
+					t.Errorf("got status %d, want %d", got, tt.wantStatus)
+				}
+			case <-time.After(time.Second):
+				t.Error("request not answered")
+			}
+			if _, err := http.Get("http://" + ln.Addr().String()); err == nil {
+				t.Error("server still accepts connections")
+			}
+		})
+	}
+}
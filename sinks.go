@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Sink types.
+const (
+	sinkFile     = "file"
+	sinkHTTP     = "http"
+	sinkStdout   = "stdout"
+	sinkForeman  = "foreman"
+	sinkStatsD   = "statsd"
+	sinkGraphite = "graphite"
+)
+
+var sinkTypes = []string{sinkFile, sinkHTTP, sinkStdout, sinkForeman, sinkStatsD, sinkGraphite}
+
+var (
+	sinkEntries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_sink_entries_total",
+			Help: "Commands passed to the sinks by result: queued or dropped when the sink buffer was full.",
+		},
+		[]string{"sink", "result"},
+	)
+	sinkErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_sink_errors_total",
+			Help: "Failed writes to the sinks.",
+		},
+		[]string{"sink"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(sinkEntries)
+	prometheus.MustRegister(sinkErrors)
+}
+
+// sinks sends the converted commands to the configured outputs besides PuppetDB.
+// It is nil outside of the server.
+var sinks *sinkSet
+
+// sinkEntry is a converted command as written by the file, HTTP and stdout sinks.
+type sinkEntry struct {
+	Time     string          `json:"time"`
+	Certname string          `json:"certname"`
+	Command  string          `json:"command"`
+	Version  int             `json:"version"`
+	Payload  json.RawMessage `json:"payload"`
+	// Report is the converted store report command, nil for other commands.
+	Report *v4Report `json:"-"`
+}
+
+// sink is an output for converted commands. Its methods are called from a
+// single goroutine, write may buffer entries until flush.
+type sink interface {
+	write(e sinkEntry) error
+	flush() error
+	close() error
+}
+
+// sinkSet holds the sink workers. The mutex guards closed, so no command is
+// written to a worker once its buffer is closed.
+type sinkSet struct {
+	mu      sync.RWMutex
+	workers []*sinkWorker
+	closed  bool
+}
+
+// sinkWorker feeds a sink from its own buffer, so a slow or failing sink
+// never holds up PuppetDB delivery or the other sinks.
+type sinkWorker struct {
+	name     string
+	commands []string
+	sink     sink
+	interval time.Duration
+	entries  chan sinkEntry
+	done     chan struct{}
+	log      *log.Logger
+}
+
+func newSinkSet(configs []sinkConfig, logger *log.Logger) (*sinkSet, error) {
+	set := new(sinkSet)
+	for _, c := range configs {
+		sk, err := newSink(c)
+		if err != nil {
+			set.close(context.Background())
+			return nil, fmt.Errorf("failed to create sink %s: %v", c.Name, err)
+		}
+		w := &sinkWorker{
+			name:     c.Name,
+			commands: c.Commands,
+			sink:     sk,
+			interval: c.FlushInterval,
+			entries:  make(chan sinkEntry, c.Buffer),
+			done:     make(chan struct{}),
+			log:      logger,
+		}
+		go w.run()
+		set.workers = append(set.workers, w)
+	}
+	return set, nil
+}
+
+func newSink(c sinkConfig) (sink, error) {
+	switch c.Type {
+	case sinkFile:
+		return newFileSink(c.Path)
+	case sinkHTTP:
+		return newHTTPSink(c)
+	case sinkStdout:
+		return &streamSink{w: os.Stdout}, nil
+	case sinkForeman:
+		return newForemanSink(c)
+	case sinkStatsD, sinkGraphite:
+		return newMetricsSink(c)
+	}
+	return nil, fmt.Errorf("unknown sink type %q", c.Type)
+}
+
+// write queues the converted command to every sink that wants it.
+func (set *sinkSet) write(certname string, v4c v4Commands) {
+	if set == nil || len(set.workers) == 0 {
+		return
+	}
+	e := sinkEntry{
+		Time:     time.Now().Format(time.RFC3339),
+		Certname: certname,
+		Command:  v4c.Command,
+		Version:  v4c.Version,
+		Payload:  v4c.Payload,
+		Report:   v4c.Report,
+	}
+
+	set.mu.RLock()
+	defer set.mu.RUnlock()
+	if set.closed {
+		return
+	}
+	for _, w := range set.workers {
+		if len(w.commands) > 0 && !contains(w.commands, dumpCommandName(e.Command)) {
+			continue
+		}
+		select {
+		case w.entries <- e:
+			sinkEntries.WithLabelValues(w.name, "queued").Inc()
+		default:
+			sinkEntries.WithLabelValues(w.name, "dropped").Inc()
+			w.log.Warnf("sink %s buffer is full, dropping %s command of %s", w.name, e.Command, certname)
+		}
+	}
+}
+
+// close flushes and closes all sinks until ctx is done.
+func (set *sinkSet) close(ctx context.Context) error {
+	if set == nil {
+		return nil
+	}
+	set.mu.Lock()
+	if !set.closed {
+		set.closed = true
+		for _, w := range set.workers {
+			close(w.entries)
+		}
+	}
+	set.mu.Unlock()
+
+	for _, w := range set.workers {
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return fmt.Errorf("sink %s: %v", w.name, ctx.Err())
+		}
+	}
+	return nil
+}
+
+func (w *sinkWorker) run() {
+	defer close(w.done)
+
+	tick := time.NewTicker(w.interval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case e, ok := <-w.entries:
+			if !ok {
+				w.check(w.sink.flush())
+				w.check(w.sink.close())
+				return
+			}
+			w.check(w.sink.write(e))
+		case <-tick.C:
+			w.check(w.sink.flush())
+		}
+	}
+}
+
+func (w *sinkWorker) check(err error) {
+	if err != nil {
+		sinkErrors.WithLabelValues(w.name).Inc()
+		w.log.Errorf("sink %s: %v", w.name, err)
+	}
+}
+
+// fileSink appends the entries as JSON lines to a file.
+type fileSink struct {
+	f *os.File
+	streamSink
+}
+
+func newFileSink(path string) (*fileSink, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return nil, err
+	}
+	s := &fileSink{f: f}
+	s.b = bufio.NewWriter(f)
+	s.w = s.b
+	return s, nil
+}
+
+func (s *fileSink) close() error {
+	if err := s.flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// streamSink writes the entries as JSON lines, buffered if b is set.
+type streamSink struct {
+	w io.Writer
+	b *bufio.Writer
+}
+
+func (s *streamSink) write(e sinkEntry) error {
+	j, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	_, err = s.w.Write(append(j, '\n'))
+	return err
+}
+
+func (s *streamSink) flush() error {
+	if s.b == nil {
+		return nil
+	}
+	return s.b.Flush()
+}
+
+func (s *streamSink) close() error {
+	return s.flush()
+}
+
+// httpSink posts batches of entries as newline delimited JSON.
+type httpSink struct {
+	url       string
+	headers   map[string]string
+	batchSize int
+	client    *http.Client
+	batch     bytes.Buffer
+	n         int
+}
+
+func newHTTPSink(c sinkConfig) (*httpSink, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &httpSink{
+		url:       c.URL,
+		headers:   c.Headers,
+		batchSize: c.BatchSize,
+		client:    &http.Client{Timeout: c.Timeout, Transport: transport},
+	}, nil
+}
+
+func (s *httpSink) write(e sinkEntry) error {
+	j, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	s.batch.Write(j)
+	s.batch.WriteByte('\n')
+	s.n++
+	if s.n >= s.batchSize {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush posts the batch. A failed batch is dropped, so a broken endpoint
+// doesn't grow the memory.
+func (s *httpSink) flush() error {
+	if s.n == 0 {
+		return nil
+	}
+	n := s.n
+	defer func() {
+		s.batch.Reset()
+		s.n = 0
+	}()
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(s.batch.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post %d entries: %v", n, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to post %d entries: %s returned %s", n, s.url, resp.Status)
+	}
+	return nil
+}
+
+func (s *httpSink) close() error {
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func newTestSinkSet(t *testing.T, configs []sinkConfig) *sinkSet {
+	l := log.New()
+	l.Out = ioutil.Discard
+	for i := range configs {
+		if err := configs[i].init(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set, err := newSinkSet(configs, l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+// readSinkFile returns the commands of the entries written by a file sink.
+func readSinkFile(t *testing.T, path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var commands []string
+	lines := bufio.NewScanner(f)
+	for lines.Scan() {
+		var e sinkEntry
+		if err := json.Unmarshal(lines.Bytes(), &e); err != nil {
+			t.Fatal(err)
+		}
+		commands = append(commands, e.Command)
+	}
+	return commands
+}
+
+func TestSinkSetWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "puppetdb-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name     string
+		commands []string
+		want     []string
+	}{
+		{
+			name: "all",
+			want: []string{"replace facts", "replace catalog", "store report"},
+		},
+		{
+			name:     "reports",
+			commands: []string{"report"},
+			want:     []string{"store report"},
+		},
+		{
+			name:     "facts and catalogs",
+			commands: []string{"facts", "catalog"},
+			want:     []string{"replace facts", "replace catalog"},
+		},
+	}
+	var configs []sinkConfig
+	for _, tt := range tests {
+		configs = append(configs, sinkConfig{Name: tt.name, Type: sinkFile, Commands: tt.commands, Path: filepath.Join(dir, tt.name)})
+	}
+	set := newTestSinkSet(t, configs)
+	for _, cmd := range []string{"replace facts", "replace catalog", "store report"} {
+		set.write("web01.example.com", v4Commands{Command: cmd, Payload: json.RawMessage(`{}`)})
+	}
+	if err := set.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := readSinkFile(t, filepath.Join(dir, tt.name)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSinkSetFull(t *testing.T) {
+	l := log.New()
+	l.Out = ioutil.Discard
+	// The worker isn't running, so the second entry doesn't fit in the buffer.
+	w := &sinkWorker{name: "full", entries: make(chan sinkEntry, 1), done: make(chan struct{}), log: l}
+	set := &sinkSet{workers: []*sinkWorker{w}}
+
+	queued := counterValue(sinkEntries, "full", "queued")
+	dropped := counterValue(sinkEntries, "full", "dropped")
+	set.write("web01.example.com", v4Commands{Command: "replace facts"})
+	set.write("web01.example.com", v4Commands{Command: "replace facts"})
+	if got := counterValue(sinkEntries, "full", "queued") - queued; got != 1 {
+		t.Errorf("got %v queued entries, want 1", got)
+	}
+	if got := counterValue(sinkEntries, "full", "dropped") - dropped; got != 1 {
+		t.Errorf("got %v dropped entries, want 1", got)
+	}
+
+	close(w.done)
+	if err := set.close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// Commands converted after the shutdown are ignored.
+	set.write("web01.example.com", v4Commands{Command: "replace facts"})
+	if got := counterValue(sinkEntries, "full", "queued") - queued; got != 1 {
+		t.Errorf("got %v queued entries after close, want 1", got)
+	}
+	if err := set.close(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHTTPSink(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		batches []int
+		status  = http.StatusOK
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != "application/x-ndjson" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("got headers %v", r.Header)
+		}
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		batches = append(batches, strings.Count(string(b), "\n"))
+		w.WriteHeader(status)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	c := sinkConfig{Type: sinkHTTP, URL: srv.URL, BatchSize: 2, Headers: map[string]string{"Authorization": "Bearer secret"}}
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+	s, err := newHTTPSink(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := s.write(sinkEntry{Command: "replace facts", Payload: json.RawMessage(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{2, 1}; !reflect.DeepEqual(batches, want) {
+		t.Errorf("got batches %v, want %v", batches, want)
+	}
+
+	// A failed batch is dropped.
+	mu.Lock()
+	status = http.StatusServiceUnavailable
+	mu.Unlock()
+	s.write(sinkEntry{Command: "replace facts", Payload: json.RawMessage(`{}`)})
+	if err := s.flush(); err == nil {
+		t.Error("no error from a failing endpoint")
+	}
+	if s.n != 0 || s.batch.Len() != 0 {
+		t.Errorf("got %d entries left in the batch", s.n)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"text/template"
+	"time"
+)
+
+// defaultMetricTemplate names the StatsD and Graphite metrics of a node.
+const defaultMetricTemplate = "puppet.{{.Certname}}.{{.Metric}}"
+
+// statsdMaxPacket keeps StatsD packets under the usual Ethernet MTU.
+const statsdMaxPacket = 1432
+
+// graphiteMaxBuffer is flushed early, so a burst of reports doesn't wait
+// for the flush interval.
+const graphiteMaxBuffer = 64 * 1024
+
+var metricNameUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]`)
+
+// metricName is the data of the metric name template. Certname and
+// Environment have dots and other unsafe characters replaced with "_".
+type metricName struct {
+	Certname    string
+	Environment string
+	Metric      string
+}
+
+// runMetric is a metric of a report, counters are sent as StatsD counters
+// and the others as gauges.
+type runMetric struct {
+	name    string
+	value   float64
+	counter bool
+}
+
+// metricsSink sends per node run metrics of the reports with the StatsD or
+// the Graphite plaintext protocol.
+type metricsSink struct {
+	kind     string
+	network  string
+	address  string
+	timeout  time.Duration
+	template *template.Template
+	conn     net.Conn
+	buf      bytes.Buffer
+}
+
+func newMetricsSink(c sinkConfig) (*metricsSink, error) {
+	t, err := parseMetricTemplate(c.Template)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsSink{
+		kind:     c.Type,
+		network:  c.Protocol,
+		address:  c.Address,
+		timeout:  c.Timeout,
+		template: t,
+	}, nil
+}
+
+func parseMetricTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultMetricTemplate
+	}
+	return template.New("metric").Parse(text)
+}
+
+func (s *metricsSink) write(e sinkEntry) error {
+	r := e.Report
+	if r == nil {
+		return nil
+	}
+
+	data := metricName{
+		Certname:    metricNameUnsafe.ReplaceAllString(r.Certname, "_"),
+		Environment: metricNameUnsafe.ReplaceAllString(r.Environment, "_"),
+	}
+	timestamp := time.Now().Unix()
+	if end, err := time.Parse(time.RFC3339Nano, r.EndTime); err == nil {
+		timestamp = end.Unix()
+	}
+
+	for _, m := range reportRunMetrics(r) {
+		data.Metric = m.name
+		var name bytes.Buffer
+		if err := s.template.Execute(&name, data); err != nil {
+			return err
+		}
+		value := strconv.FormatFloat(m.value, 'f', -1, 64)
+
+		var line string
+		switch {
+		case s.kind == sinkGraphite:
+			line = fmt.Sprintf("%s %s %d\n", name.String(), value, timestamp)
+		case m.counter:
+			line = fmt.Sprintf("%s:%s|c\n", name.String(), value)
+		default:
+			line = fmt.Sprintf("%s:%s|g\n", name.String(), value)
+		}
+
+		if s.kind == sinkStatsD && s.buf.Len()+len(line) > statsdMaxPacket {
+			if err := s.flush(); err != nil {
+				return err
+			}
+		}
+		s.buf.WriteString(line)
+	}
+
+	if s.kind == sinkGraphite && s.buf.Len() > graphiteMaxBuffer {
+		return s.flush()
+	}
+	return nil
+}
+
+// flush sends the buffered metrics. They are dropped on error, and the
+// connection is dialed again on the next flush.
+func (s *metricsSink) flush() error {
+	if s.buf.Len() == 0 {
+		return nil
+	}
+	defer s.buf.Reset()
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, s.timeout)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeout))
+	if _, err := s.conn.Write(s.buf.Bytes()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (s *metricsSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// reportRunMetrics returns the event counts by status, the changed and
+// failed resources and the run time of the report.
+func reportRunMetrics(r *v4Report) []runMetric {
+	events, resources := reportCounts(r)
+
+	var metrics []runMetric
+	for _, status := range []string{"failure", "noop", "success"} {
+		metrics = append(metrics, runMetric{name: "events." + status, value: events[status], counter: true})
+	}
+	metrics = append(metrics,
+		runMetric{name: "resources.changed", value: resources["changed"]},
+		runMetric{name: "resources.failed", value: resources["failed"]},
+		runMetric{name: "time.total", value: runDuration(r)},
+	)
+	return metrics
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readMetrics listens for one StatsD packet or Graphite connection and sends
+// the lines received.
+func readMetrics(t *testing.T, protocol string) (string, <-chan []string) {
+	lines := make(chan []string, 1)
+	split := func(b []byte) []string {
+		return strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")
+	}
+	if protocol == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			defer conn.Close()
+			b := make([]byte, statsdMaxPacket)
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, _ := conn.ReadFrom(b)
+			lines <- split(b[:n])
+		}()
+		return conn.LocalAddr().String(), lines
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			lines <- nil
+			return
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		b, _ := ioutil.ReadAll(conn)
+		lines <- split(b)
+	}()
+	return l.Addr().String(), lines
+}
+
+func TestMetricsSink(t *testing.T) {
+	report := &v4Report{
+		Certname:    "web01.example.com",
+		Environment: "production",
+		StartTime:   "2019-01-02T03:04:00.000Z",
+		EndTime:     "2019-01-02T03:04:05.000Z",
+		Resources: v4Resources{
+			{Events: []v4ResourceEventExpanded{{Status: "success"}, {Status: "success"}}},
+			{Events: []v4ResourceEventExpanded{{Status: "failure"}}},
+		},
+	}
+	tests := []struct {
+		name     string
+		kind     string
+		template string
+		want     []string
+	}{
+		{
+			name: "statsd",
+			kind: sinkStatsD,
+			want: []string{
+				"puppet.web01_example_com.events.failure:1|c",
+				"puppet.web01_example_com.events.noop:0|c",
+				"puppet.web01_example_com.events.success:2|c",
+				"puppet.web01_example_com.resources.changed:1|g",
+				"puppet.web01_example_com.resources.failed:1|g",
+				"puppet.web01_example_com.time.total:5|g",
+			},
+		},
+		{
+			name:     "graphite",
+			kind:     sinkGraphite,
+			template: "{{.Environment}}.{{.Certname}}.{{.Metric}}",
+			want: []string{
+				"production.web01_example_com.events.failure 1 1546398245",
+				"production.web01_example_com.events.noop 0 1546398245",
+				"production.web01_example_com.events.success 2 1546398245",
+				"production.web01_example_com.resources.changed 1 1546398245",
+				"production.web01_example_com.resources.failed 1 1546398245",
+				"production.web01_example_com.time.total 5 1546398245",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := sinkConfig{Type: tt.kind, Template: tt.template, Address: "127.0.0.1:0"}
+			if err := c.init(); err != nil {
+				t.Fatal(err)
+			}
+			var lines <-chan []string
+			c.Address, lines = readMetrics(t, c.Protocol)
+			s, err := newMetricsSink(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.write(sinkEntry{Command: "store report", Report: report}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.flush(); err != nil {
+				t.Fatal(err)
+			}
+			s.close()
+			if got := <-lines; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsSinkConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  sinkConfig
+		wantErr bool
+	}{
+		{"statsd", sinkConfig{Type: sinkStatsD, Address: "localhost:8125"}, false},
+		{"graphite reports", sinkConfig{Type: sinkGraphite, Address: "localhost:2003", Commands: []string{"report"}}, false},
+		{"graphite facts", sinkConfig{Type: sinkGraphite, Address: "localhost:2003", Commands: []string{"facts"}}, true},
+		{"no address", sinkConfig{Type: sinkStatsD}, true},
+		{"invalid protocol", sinkConfig{Type: sinkStatsD, Address: "localhost:8125", Protocol: "unix"}, true},
+		{"invalid template", sinkConfig{Type: sinkStatsD, Address: "localhost:8125", Template: "{{.Certname"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.init()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v", err)
+			}
+			if err == nil && !reflect.DeepEqual(tt.config.Commands, []string{"report"}) {
+				t.Errorf("got commands %v", tt.config.Commands)
+			}
+		})
+	}
+}
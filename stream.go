@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// streamRoute is the name of the event stream routes, which are left out of
+// the request metrics as they last as long as the client is connected.
+const streamRoute = "stream"
+
+var errTooManySubscribers = errors.New("too many stream subscribers")
+
+var (
+	streamSubscribers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "puppetdb_proxy_stream_subscribers",
+			Help: "Clients connected to the event streams.",
+		},
+	)
+	streamDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "puppetdb_proxy_stream_events_dropped_total",
+			Help: "Stream events dropped because the buffer of a slow subscriber was full.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(streamSubscribers)
+	prometheus.MustRegister(streamDropped)
+}
+
+// streams sends summaries of the processed commands to the stream subscribers.
+// It is nil outside of the server.
+var streams *streamBroker
+
+// streamSummary is the compact form of a command sent to subscribers.
+type streamSummary struct {
+	Time            string         `json:"time"`
+	Certname        string         `json:"certname"`
+	Command         string         `json:"command"`
+	Version         int            `json:"version"`
+	Environment     string         `json:"environment,omitempty"`
+	Status          string         `json:"status,omitempty"`
+	Result          string         `json:"result"`
+	Events          map[string]int `json:"events,omitempty"`
+	FailedResources []string       `json:"failed_resources,omitempty"`
+}
+
+type streamBroker struct {
+	mu     sync.Mutex
+	subs   map[*streamSubscriber]struct{}
+	closed bool
+}
+
+// streamSubscriber is a connected client with its filters. Events that don't
+// fit in its buffer are dropped and counted, so a slow client never blocks
+// command processing.
+type streamSubscriber struct {
+	certnames []string
+	statuses  []string
+	commands  []string
+	events    chan streamSummary
+	dropped   uint64
+	done      chan struct{}
+}
+
+func newStreamBroker() *streamBroker {
+	return &streamBroker{subs: make(map[*streamSubscriber]struct{})}
+}
+
+func (b *streamBroker) subscribe(sub *streamSubscriber) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return errTooManySubscribers
+	}
+	if max := conf().Stream.MaxSubscribers; max > 0 && len(b.subs) >= max {
+		return errTooManySubscribers
+	}
+	b.subs[sub] = struct{}{}
+	streamSubscribers.Inc()
+
+	return nil
+}
+
+func (b *streamBroker) unsubscribe(sub *streamSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		streamSubscribers.Dec()
+	}
+}
+
+// publish sends the summary of a processed command to the matching subscribers.
+func (b *streamBroker) publish(certname string, v4c v4Commands, result string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.subs) == 0 {
+		return
+	}
+	e := newStreamSummary(certname, v4c, result)
+	for sub := range b.subs {
+		if !sub.match(e) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			streamDropped.Inc()
+		}
+	}
+}
+
+// close ends all streams, so they don't hold up the shutdown.
+func (b *streamBroker) close() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for sub := range b.subs {
+		close(sub.done)
+		delete(b.subs, sub)
+		streamSubscribers.Dec()
+	}
+}
+
+func newStreamSummary(certname string, v4c v4Commands, result string) streamSummary {
+	var e streamSummary
+	e.Time = time.Now().Format(time.RFC3339)
+	e.Certname = certname
+	e.Command = v4c.Command
+	e.Version = v4c.Version
+	e.Result = result
+	e.Environment, _ = conf().rewrite(certname)
+
+	r := v4c.Report
+	if r == nil {
+		return e
+	}
+	e.Environment = r.Environment
+	e.Status = r.Status
+	e.Events = make(map[string]int)
+	for _, res := range r.Resources {
+		var failed bool
+		for _, ev := range res.Events {
+			e.Events[ev.Status]++
+			if ev.Status == "failure" {
+				failed = true
+			}
+		}
+		if failed {
+			e.FailedResources = append(e.FailedResources, fmt.Sprintf("%s[%s]", res.ResourceType, res.ResourceTitle))
+		}
+	}
+
+	return e
+}
+
+// newStreamSubscriber reads the filters of a stream request: certname globs,
+// report statuses and, for the commands stream, short command names. Filters
+// can be repeated or comma separated.
+func newStreamSubscriber(r *http.Request, commands []string) (*streamSubscriber, error) {
+	q := r.URL.Query()
+	sub := &streamSubscriber{
+		certnames: splitParams(q["certname"]),
+		statuses:  splitParams(q["status"]),
+		commands:  commands,
+		events:    make(chan streamSummary, conf().Stream.Buffer),
+		done:      make(chan struct{}),
+	}
+	if len(commands) == 0 {
+		sub.commands = splitParams(q["command"])
+	}
+	for _, p := range sub.certnames {
+		if err := checkPattern(p); err != nil {
+			return nil, err
+		}
+	}
+
+	return sub, nil
+}
+
+func (sub *streamSubscriber) match(e streamSummary) bool {
+	if len(sub.commands) > 0 && !contains(sub.commands, dumpCommandName(e.Command)) {
+		return false
+	}
+	if len(sub.statuses) > 0 && !contains(sub.statuses, e.Status) {
+		return false
+	}
+	if len(sub.certnames) == 0 {
+		return true
+	}
+	for _, p := range sub.certnames {
+		if ok, _ := path.Match(p, e.Certname); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *server) streamReportsHandler(w http.ResponseWriter, r *http.Request) {
+	s.stream(w, r, []string{"report"})
+}
+
+func (s *server) streamCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	s.stream(w, r, nil)
+}
+
+// stream sends the matching command summaries as server-sent events until
+// the client disconnects or the server shuts down.
+func (s *server) stream(w http.ResponseWriter, r *http.Request, commands []string) {
+	sub, err := newStreamSubscriber(r, commands)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	err = streams.subscribe(sub)
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(err.Error()))
+		s.Log.Warnf("refused stream for %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer streams.unsubscribe(sub)
+
+	// The stream outlives the server write timeout.
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		s.Log.Debugf("failed to clear write deadline of stream for %s: %v", r.RemoteAddr, err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		s.Log.Errorf("failed to flush stream for %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	keepalive := time.NewTicker(conf().Stream.Keepalive)
+	defer keepalive.Stop()
+
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.done:
+			return
+		case <-keepalive.C:
+			_, err = w.Write([]byte(": keepalive\n\n"))
+		case e := <-sub.events:
+			if n := atomic.SwapUint64(&sub.dropped, 0); n > 0 {
+				fmt.Fprintf(w, "event: dropped\ndata: {\"count\":%d}\n\n", n)
+			}
+			var j []byte
+			j, err = json.Marshal(&e)
+			if err == nil {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", dumpCommandName(e.Command), j)
+			}
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			s.Log.Debugf("stream for %s closed: %v", r.RemoteAddr, err)
+			return
+		}
+	}
+}
+
+// splitParams splits comma separated query parameters.
+func splitParams(params []string) []string {
+	var values []string
+	for _, p := range params {
+		for _, v := range strings.Split(p, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				values = append(values, v)
+			}
+		}
+	}
+	return values
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestStreamSubscriberMatch(t *testing.T) {
+	report := v4Commands{Command: "store report", Version: 8, Report: &v4Report{Certname: "web01.example.com", Status: "failed"}}
+	facts := v4Commands{Command: "replace facts", Version: 5}
+	tests := []struct {
+		name     string
+		query    string
+		commands []string
+		v4c      v4Commands
+		want     bool
+	}{
+		{
+			name: "no filters",
+			v4c:  facts,
+			want: true,
+		},
+		{
+			name:  "certname glob",
+			query: "certname=db*,web*",
+			v4c:   report,
+			want:  true,
+		},
+		{
+			name:  "other certname",
+			query: "certname=db*",
+			v4c:   report,
+		},
+		{
+			name:  "status",
+			query: "status=failed&status=changed",
+			v4c:   report,
+			want:  true,
+		},
+		{
+			name:  "other status",
+			query: "status=changed",
+			v4c:   report,
+		},
+		{
+			name:  "command",
+			query: "command=facts",
+			v4c:   facts,
+			want:  true,
+		},
+		{
+			name:     "reports stream ignores the command filter",
+			query:    "command=facts",
+			commands: []string{"report"},
+			v4c:      facts,
+		},
+	}
+	setTestConfig(t, &config{Stream: streamConfig{Buffer: 1}})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/stream/commands?"+tt.query, nil)
+			sub, err := newStreamSubscriber(r, tt.commands)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sub.match(newStreamSummary("web01.example.com", tt.v4c, "ok")); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/stream/commands?certname=[web", nil)
+	if _, err := newStreamSubscriber(r, nil); err == nil {
+		t.Error("no error for an invalid certname pattern")
+	}
+}
+
+func TestStreamBroker(t *testing.T) {
+	setTestConfig(t, &config{Stream: streamConfig{Buffer: 1, MaxSubscribers: 1}})
+	b := newStreamBroker()
+	r := httptest.NewRequest(http.MethodGet, "/stream/commands", nil)
+	sub, _ := newStreamSubscriber(r, nil)
+	if err := b.subscribe(sub); err != nil {
+		t.Fatal(err)
+	}
+	other, _ := newStreamSubscriber(r, nil)
+	if err := b.subscribe(other); err != errTooManySubscribers {
+		t.Errorf("got error %v, want %v", err, errTooManySubscribers)
+	}
+
+	// The second event doesn't fit in the buffer and is dropped.
+	b.publish("web01.example.com", v4Commands{Command: "replace facts"}, "ok")
+	b.publish("web01.example.com", v4Commands{Command: "replace catalog"}, "ok")
+	if e := <-sub.events; e.Command != "replace facts" {
+		t.Errorf("got event %+v", e)
+	}
+	if sub.dropped != 1 {
+		t.Errorf("got %d dropped events, want 1", sub.dropped)
+	}
+
+	b.close()
+	select {
+	case <-sub.done:
+	default:
+		t.Error("stream not ended on close")
+	}
+	if err := b.subscribe(other); err == nil {
+		t.Error("subscribed after close")
+	}
+}
+
+func TestStreamHandler(t *testing.T) {
+	setTestConfig(t, &config{Stream: streamConfig{Buffer: 10, Keepalive: time.Minute}})
+	streams = newStreamBroker()
+	defer func() { streams = nil }()
+	s := new(server)
+	s.Log = log.New()
+	s.Log.Out = ioutil.Discard
+	srv := httptest.NewServer(http.HandlerFunc(s.streamReportsHandler))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "?status=failed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("got content type %q", ct)
+	}
+
+	report := &v4Report{Certname: "web01.example.com", Status: "failed", Resources: v4Resources{
+		{ResourceType: "File", ResourceTitle: "/etc/motd", Events: []v4ResourceEventExpanded{{Status: "failure"}}},
+	}}
+	streams.publish("web01.example.com", v4Commands{Command: "replace facts"}, "ok")
+	streams.publish("web01.example.com", v4Commands{Command: "store report", Report: &v4Report{Status: "changed"}}, "ok")
+	streams.publish("web01.example.com", v4Commands{Command: "store report", Report: report}, "ok")
+
+	lines := bufio.NewReader(resp.Body)
+	event, _ := lines.ReadString('\n')
+	data, _ := lines.ReadString('\n')
+	if event != "event: report\n" {
+		t.Errorf("got %q, want a report event", event)
+	}
+	if !strings.Contains(data, `"status":"failed"`) || !strings.Contains(data, `"failed_resources":["File[/etc/motd]"]`) {
+		t.Errorf("got data %q", data)
+	}
+}